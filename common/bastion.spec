@@ -86,8 +86,10 @@ rm -rf %{buildroot}
 
 install -dm 755 %{buildroot}%{_bindir}
 install -dm 755 %{buildroot}%{_sysconfdir}
+install -dm 755 %{buildroot}%{_sysconfdir}/%{name}.d
 install -dm 755 %{buildroot}%{_initddir}
 install -dm 755 %{buildroot}%{_logdir}/%{name}
+install -dm 700 %{buildroot}%{_sharedstatedir}/%{name}
 
 install -pm 755 %{srcdir}/%{name} \
                 %{buildroot}%{_bindir}/
@@ -107,7 +109,9 @@ rm -rf %{buildroot}
 %defattr(-,root,root,-)
 %doc LICENSE
 %dir %{_logdir}/%{name}
+%dir %{_sharedstatedir}/%{name}
 %config(noreplace) %{_sysconfdir}/%{name}.knf
+%dir %{_sysconfdir}/%{name}.d
 %{_initddir}/%{name}
 %{_bindir}/%{name}
 
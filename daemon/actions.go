@@ -0,0 +1,288 @@
+package daemon
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+//                                                                                    //
+//                         Copyright (c) 2022 ESSENTIAL KAOS                          //
+//      Apache License, Version 2.0 <https://www.apache.org/licenses/LICENSE-2.0>     //
+//                                                                                    //
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+import (
+	"github.com/essentialkaos/ek/v12/initsystem"
+	"github.com/essentialkaos/ek/v12/log"
+)
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// Lockdown levels
+const (
+	LEVEL_FULL       = "full"       // sshd is stopped
+	LEVEL_RESTRICTED = "restricted" // sshd works with restricted configuration
+)
+
+// Actions names
+const (
+	ACTION_DISABLE_SSHD   = "disable-sshd"
+	ACTION_STOP_SSHD      = "stop-sshd"
+	ACTION_ENABLE_BASTION = "enable-bastion"
+	ACTION_RESTRICT_SSHD  = "restrict-sshd"
+	ACTION_NOLOGIN        = "nologin"
+	ACTION_FIREWALL       = "firewall"
+	ACTION_KILL_SESSIONS  = "kill-sessions"
+	ACTION_LOCK_ACCOUNTS  = "lock-accounts"
+)
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// Action is single reversible step of bastion mode enabling
+type Action struct {
+	Name    string
+	Apply   func() error
+	Revert  func() error
+	Check   func() (bool, error) // Returns true if action is applied
+	OneShot bool                 // Action has no persistent state, so it is never re-applied
+}
+
+// serviceOp is operation with service
+type serviceOp struct {
+	Func     func(name string) error
+	Check    func(name string) (bool, error)
+	Progress string
+	Done     string
+}
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+var (
+	opEnable  = serviceOp{enableService, isServiceEnabled, "Enabling", "enabled"}
+	opDisable = serviceOp{disableService, isServiceDisabled, "Disabling", "disabled"}
+	opStart   = serviceOp{startService, isServiceRunning, "Starting", "started"}
+	opStop    = serviceOp{stopService, isServiceNotRunning, "Stopping", "stopped"}
+)
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// getActions returns ordered list of actions of given profile for enabling
+// bastion mode
+func getActions(profile string) []*Action {
+	actions, err := getProfileActions(profile)
+
+	if err != nil {
+		log.Error("%v, using %s profile", err, PROFILE_STANDARD)
+		actions, _ = getProfileActions(PROFILE_STANDARD)
+	}
+
+	return actions
+}
+
+// getMarkerActions returns ordered list of actions recorded in marker, so
+// actions are reverted correctly even if configuration was changed
+func getMarkerActions(marker *BastionMarker) []*Action {
+	if marker == nil {
+		return getActions("")
+	}
+
+	if len(marker.Actions) == 0 {
+		return getActions(marker.Profile)
+	}
+
+	var result []*Action
+
+	for _, info := range marker.Actions {
+		action := getKnownAction(info.Name)
+
+		if action == nil {
+			log.Error("Marker contains unknown action %s", info.Name)
+			continue
+		}
+
+		result = append(result, action)
+	}
+
+	return result
+}
+
+// getRevertOrder returns actions in order of reverting, actions are reverted
+// in reverse order, but bastion autostart is disabled last, after access to
+// server is restored
+func getRevertOrder(actions []*Action) []*Action {
+	var result []*Action
+	var deferred *Action
+
+	for i := len(actions) - 1; i >= 0; i-- {
+		if actions[i].Name == ACTION_ENABLE_BASTION {
+			deferred = actions[i]
+			continue
+		}
+
+		result = append(result, actions[i])
+	}
+
+	if deferred != nil {
+		result = append(result, deferred)
+	}
+
+	return result
+}
+
+// getKnownAction returns action with given name
+func getKnownAction(name string) *Action {
+	for _, action := range getKnownActions() {
+		if action.Name == name {
+			return action
+		}
+	}
+
+	return nil
+}
+
+// getKnownActions returns list of all supported actions
+func getKnownActions() []*Action {
+	return []*Action{
+		newServiceAction(ACTION_DISABLE_SSHD, "sshd", opDisable, opEnable),
+		newServiceAction(ACTION_STOP_SSHD, "sshd", opStop, opStart),
+		newServiceAction(ACTION_ENABLE_BASTION, "bastion", opEnable, opDisable),
+		newRestrictSSHDAction(),
+		newNologinAction(),
+		newFirewallAction(),
+		newKillSessionsAction(),
+		newLockAccountsAction(),
+	}
+}
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// applyAction saves prior state of action to marker and applies action
+func applyAction(action *Action) error {
+	priorApplied, err := action.Check()
+
+	if err != nil {
+		priorApplied = false
+	}
+
+	err = addMarkerAction(action.Name, priorApplied)
+
+	if err != nil {
+		return err
+	}
+
+	err = action.Apply()
+
+	if err != nil {
+		logEvent(
+			EVENT_LEVEL_ERROR,
+			&Event{Event: EVENT_ACTION_FAILED, Action: action.Name, Error: err.Error()},
+			"Can't apply action %s: %v", action.Name, err,
+		)
+		return err
+	}
+
+	logEvent(
+		EVENT_LEVEL_INFO,
+		&Event{Event: EVENT_ACTION_APPLIED, Action: action.Name},
+		"Action %s applied", action.Name,
+	)
+
+	return nil
+}
+
+// reapplyAction applies action from marker again if it was reverted by
+// someone else or after reboot
+func reapplyAction(action *Action) {
+	err := action.Apply()
+
+	if err != nil {
+		logEvent(
+			EVENT_LEVEL_CRIT,
+			&Event{Event: EVENT_ACTION_FAILED, Action: action.Name, Error: err.Error()},
+			"Can't re-apply action %s: %v", action.Name, err,
+		)
+		return
+	}
+
+	logEvent(
+		EVENT_LEVEL_WARN,
+		&Event{Event: EVENT_ACTION_REAPPLIED, Action: action.Name},
+		"Action %s re-applied", action.Name,
+	)
+}
+
+// revertAction reverts action if it wasn't applied before bastion mode
+func revertAction(action *Action, marker *BastionMarker) error {
+	if marker != nil {
+		info := marker.GetAction(action.Name)
+
+		if info != nil && info.PriorApplied {
+			log.Info("Action %s was applied before bastion mode, reverting skipped", action.Name)
+			return nil
+		}
+	}
+
+	err := action.Revert()
+
+	if err != nil {
+		logEvent(
+			EVENT_LEVEL_ERROR,
+			&Event{Event: EVENT_ACTION_FAILED, Action: action.Name, Error: err.Error()},
+			"Can't revert action %s: %v", action.Name, err,
+		)
+		return err
+	}
+
+	logEvent(
+		EVENT_LEVEL_INFO,
+		&Event{Event: EVENT_ACTION_REVERTED, Action: action.Name},
+		"Action %s reverted", action.Name,
+	)
+
+	return nil
+}
+
+// newServiceAction creates action which changes service state
+func newServiceAction(name, service string, apply, revert serviceOp) *Action {
+	return &Action{
+		Name:   name,
+		Apply:  serviceStep(apply, service),
+		Revert: serviceStep(revert, service),
+		Check:  func() (bool, error) { return apply.Check(service) },
+	}
+}
+
+// serviceStep returns function which applies given operation to service
+func serviceStep(op serviceOp, service string) func() error {
+	return func() error {
+		log.Info("%s %s service...", op.Progress, service)
+
+		err := op.Func(service)
+
+		if err != nil {
+			return err
+		}
+
+		log.Info("%s service %s", service, op.Done)
+
+		return nil
+	}
+}
+
+// isServiceEnabled returns true if service autostart is enabled
+func isServiceEnabled(name string) (bool, error) {
+	return initsystem.IsEnabled(name)
+}
+
+// isServiceDisabled returns true if service autostart is disabled
+func isServiceDisabled(name string) (bool, error) {
+	enabled, err := initsystem.IsEnabled(name)
+	return !enabled, err
+}
+
+// isServiceRunning returns true if service works
+func isServiceRunning(name string) (bool, error) {
+	return initsystem.IsWorks(name)
+}
+
+// isServiceNotRunning returns true if service is stopped
+func isServiceNotRunning(name string) (bool, error) {
+	works, err := initsystem.IsWorks(name)
+	return !works, err
+}
@@ -0,0 +1,338 @@
+package daemon
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+//                                                                                    //
+//                         Copyright (c) 2022 ESSENTIAL KAOS                          //
+//      Apache License, Version 2.0 <https://www.apache.org/licenses/LICENSE-2.0>     //
+//                                                                                    //
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/essentialkaos/ek/v12/fsutil"
+	"github.com/essentialkaos/ek/v12/knf"
+	"github.com/essentialkaos/ek/v12/log"
+)
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// SOURCE_JOURNAL is name of auth log source for reading systemd journal
+const SOURCE_JOURNAL = "journal"
+
+// TAIL_INTERVAL is interval between checks for new data in auth log
+const TAIL_INTERVAL = time.Second
+
+// MAX_REASON_LINES is maximum number of matched lines saved to marker
+const MAX_REASON_LINES = 10
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// authRule is rule which matches if number of events in window reaches limit
+type authRule struct {
+	Name   string
+	Limit  int
+	Window time.Duration
+	events []authEvent
+}
+
+// authEvent is matched auth log line
+type authEvent struct {
+	Time time.Time
+	Line string
+}
+
+// authWatcher watches auth log and enables bastion mode if rule matches
+type authWatcher struct {
+	rootFails *authRule
+	fails     *authRule
+	knownNets []*net.IPNet
+}
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+var (
+	// sshdLineRegex matches syslog record (with traditional or RFC 3339
+	// timestamp) of sshd and captures message
+	sshdLineRegex = regexp.MustCompile(
+		`^(?:\w{3} +\d+ \d\d:\d\d:\d\d|\d{4}-\d\d-\d\dT\S+) \S+ (?:sshd|sshd-session)\[\d+\]: (.*)$`,
+	)
+
+	failedRegex   = regexp.MustCompile(`^Failed \S+ for (invalid user )?(\S+) from (\S+) port \d+ ssh2$`)
+	acceptedRegex = regexp.MustCompile(`^Accepted \S+ for (\S+) from (\S+) port \d+ ssh2(?:: .*)?$`)
+)
+
+// authLogFiles is list of auth log files checked in auto mode
+var authLogFiles = []string{"/var/log/secure", "/var/log/auth.log"}
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// startAuthLogWatcher starts auth log watcher if it enabled
+func startAuthLogWatcher() error {
+	if !knf.GetB(AUTHLOG_ENABLED) {
+		return nil
+	}
+
+	knownNets, err := parseNetList(knf.GetS(AUTHLOG_KNOWN_NETS))
+
+	if err != nil {
+		return fmt.Errorf("Can't parse known networks list: %v", err)
+	}
+
+	w := &authWatcher{
+		rootFails: &authRule{
+			Name:   "root-fails",
+			Limit:  knf.GetI(AUTHLOG_ROOT_FAILS, 5),
+			Window: time.Duration(knf.GetI(AUTHLOG_ROOT_FAILS_WINDOW, 10)) * time.Minute,
+		},
+		fails: &authRule{
+			Name:   "fails",
+			Limit:  knf.GetI(AUTHLOG_FAILS),
+			Window: time.Duration(knf.GetI(AUTHLOG_FAILS_WINDOW, 10)) * time.Minute,
+		},
+		knownNets: knownNets,
+	}
+
+	source := getAuthLogSource()
+
+	log.Info("Auth log watcher started (source: %s)", source)
+
+	if source == SOURCE_JOURNAL {
+		go readJournal(w.processMessage)
+	} else {
+		go tailFile(source, w.processLine)
+	}
+
+	return nil
+}
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// processLine checks auth log line, only records from sshd are checked
+func (w *authWatcher) processLine(line string) {
+	m := sshdLineRegex.FindStringSubmatch(line)
+
+	if m != nil {
+		w.processMessage(m[1])
+	}
+}
+
+// processMessage checks sshd message against rules
+func (w *authWatcher) processMessage(message string) {
+	if m := failedRegex.FindStringSubmatch(message); m != nil {
+		user, ip := m[2], m[3]
+
+		if net.ParseIP(ip) == nil {
+			return
+		}
+
+		if user == "root" {
+			w.check(w.rootFails, ip, message)
+		}
+
+		w.check(w.fails, ip, message)
+
+		return
+	}
+
+	if len(w.knownNets) == 0 {
+		return
+	}
+
+	if m := acceptedRegex.FindStringSubmatch(message); m != nil {
+		ip := net.ParseIP(m[2])
+
+		if ip == nil || isNetsContains(w.knownNets, ip) {
+			return
+		}
+
+		w.trigger("unknown-net", m[2], []string{message})
+	}
+}
+
+// check adds line to rule and triggers bastion mode if rule matches
+func (w *authWatcher) check(rule *authRule, ip, line string) {
+	lines := rule.Add(line)
+
+	if lines != nil {
+		w.trigger(rule.Name, ip, lines)
+	}
+}
+
+// trigger enables bastion mode
+func (w *authWatcher) trigger(rule, ip string, lines []string) {
+	if len(lines) > MAX_REASON_LINES {
+		lines = lines[len(lines)-MAX_REASON_LINES:]
+	}
+
+	log.Warn("[SUSPICIOUS] Auth log rule \"%s\" matched, enabling bastion mode...", rule)
+
+	err := ctrl.Activate(&Trigger{
+		Source: "authlog",
+		Actor:  ip,
+		Reason: fmt.Sprintf("Rule %s matched: %s", rule, strings.Join(lines, "; ")),
+	})
+
+	if err != nil {
+		log.Debug("Auth log trigger ignored: %v", err)
+	}
+}
+
+// Add adds event to rule and returns matched lines if limit is reached
+func (r *authRule) Add(line string) []string {
+	if r.Limit <= 0 {
+		return nil
+	}
+
+	now := time.Now()
+
+	var events []authEvent
+
+	for _, e := range r.events {
+		if now.Sub(e.Time) < r.Window {
+			events = append(events, e)
+		}
+	}
+
+	r.events = append(events, authEvent{now, line})
+
+	if len(r.events) < r.Limit {
+		return nil
+	}
+
+	var lines []string
+
+	for _, e := range r.events {
+		lines = append(lines, e.Line)
+	}
+
+	r.events = nil
+
+	return lines
+}
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// getAuthLogSource returns path to auth log or journal source
+func getAuthLogSource() string {
+	source := knf.GetS(AUTHLOG_SOURCE)
+
+	if source != "" {
+		return source
+	}
+
+	for _, file := range authLogFiles {
+		if fsutil.IsExist(file) {
+			return file
+		}
+	}
+
+	return SOURCE_JOURNAL
+}
+
+// tailFile reads new lines from file and handles file rotation
+func tailFile(file string, handler func(string)) {
+	var fd *os.File
+	var reader *bufio.Reader
+	var partial string
+
+	for {
+		if fd == nil {
+			var err error
+
+			fd, err = os.Open(file)
+
+			if err != nil {
+				time.Sleep(TAIL_INTERVAL)
+				continue
+			}
+
+			if reader == nil {
+				// Skip existing records on first open
+				fd.Seek(0, io.SeekEnd)
+			}
+
+			reader = bufio.NewReader(fd)
+		}
+
+		line, err := reader.ReadString('\n')
+
+		if err == nil {
+			handler(strings.TrimSpace(partial + line))
+			partial = ""
+			continue
+		}
+
+		// Line is not completely written yet
+		partial += line
+
+		time.Sleep(TAIL_INTERVAL)
+
+		if isFileRotated(fd, file) {
+			fd.Close()
+			fd, partial = nil, ""
+		}
+	}
+}
+
+// isFileRotated returns true if file was replaced or truncated
+func isFileRotated(fd *os.File, file string) bool {
+	fdInfo, err := fd.Stat()
+
+	if err != nil {
+		return true
+	}
+
+	fileInfo, err := os.Stat(file)
+
+	if err != nil {
+		return false
+	}
+
+	if !os.SameFile(fdInfo, fileInfo) {
+		return true
+	}
+
+	offset, _ := fd.Seek(0, io.SeekCurrent)
+
+	return fileInfo.Size() < offset
+}
+
+// readJournal reads sshd records from systemd journal, records are filtered
+// by process name set by journald, so they can't be forged with logger
+func readJournal(handler func(string)) {
+	for {
+		cmd := exec.Command("journalctl", "-f", "-n", "0", "-o", "cat", "_COMM=sshd", "_COMM=sshd-session")
+		stdout, err := cmd.StdoutPipe()
+
+		if err == nil {
+			err = cmd.Start()
+		}
+
+		if err != nil {
+			log.Error("Can't start journalctl: %v", err)
+			time.Sleep(time.Minute)
+			continue
+		}
+
+		scanner := bufio.NewScanner(stdout)
+
+		for scanner.Scan() {
+			handler(strings.TrimSpace(scanner.Text()))
+		}
+
+		cmd.Wait()
+
+		log.Warn("journalctl exited, restarting...")
+
+		time.Sleep(TAIL_INTERVAL)
+	}
+}
@@ -11,219 +11,87 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
-	"strings"
 	"time"
 
-	"github.com/essentialkaos/ek/v12/fsutil"
 	"github.com/essentialkaos/ek/v12/initsystem"
-	"github.com/essentialkaos/ek/v12/jsonutil"
 	"github.com/essentialkaos/ek/v12/knf"
 	"github.com/essentialkaos/ek/v12/log"
-	"github.com/essentialkaos/ek/v12/netutil"
-	"github.com/essentialkaos/ek/v12/passwd"
-	"github.com/essentialkaos/ek/v12/timeutil"
 )
 
 // ////////////////////////////////////////////////////////////////////////////////// //
 
-// BASTION_MARKER path to file with info about bastion mode
-const BASTION_MARKER = "/root/.bastion"
-
-// ////////////////////////////////////////////////////////////////////////////////// //
-
-type BastionMarker struct {
-	Started int64 `json:"started"`
-	Until   int64 `json:"until"`
-}
-
-// ////////////////////////////////////////////////////////////////////////////////// //
-
-var (
-	bastionMode   bool
-	bastionMarker *BastionMarker
-)
-
-// ////////////////////////////////////////////////////////////////////////////////// //
-
-func startBastionMode() {
-	duration := knf.GetI64(MAIN_DURATION, 86400)
-
-	enableBastionMode(duration)
-	waitInBastionMode()
-}
-
 // restoreBastionMode restore bastion mode after reboot
-func restoreBastionMode() {
-	var err error
-
-	log.Info("Found bastion marker, restoring bastion mode...")
-
-	bastionMode = true
-	bastionMarker, err = getBastionMarkerInfo()
-
-	if err != nil {
-		log.Crit("Can't restore bastion mode: %v", err)
-		shutdown(1)
-	}
-
-	if isServiceWorks("sshd") {
-		log.Info("Stopping sshd service...")
-
-		stopService("sshd")
-
-		if err != nil {
-			log.Error(err.Error())
-		} else {
-			log.Info("sshd service disabled")
-		}
-	}
-
-	waitInBastionMode()
-}
-
-// waitInBastionMode wait until end of bastion mode
-func waitInBastionMode() {
-	var count int
-
-	log.Info(
-		"Server will be in bastion mode till %s",
-		timeutil.Format(time.Unix(bastionMarker.Until, 0), "%Y/%m/%d %H:%M"),
-	)
-
-	for range time.NewTicker(time.Minute).C {
-		now := time.Now().Unix()
-
-		if now > bastionMarker.Until {
-			break
+func restoreBastionMode(marker *BastionMarker) {
+	for _, action := range getMarkerActions(marker) {
+		if action.OneShot {
+			continue
 		}
 
-		count++
+		applied, err := action.Check()
 
-		if count%15 != 0 {
+		if err == nil && applied {
 			continue
 		}
 
-		tillExit := bastionMarker.Until - now
-
-		log.Info(
-			"%s till exit from bastion mode",
-			timeutil.PrettyDuration(tillExit),
-		)
+		reapplyAction(action)
 	}
-
-	disableBastionMode()
 }
 
-// isBastionModeEnabled return true if bastion mode is enabled
-func isBastionModeEnabled() bool {
-	if bastionMode {
-		return true
-	}
-
-	return isBastionMarkerExist()
-}
-
-// enableBastionMode enable bastion mode on server
-func enableBastionMode(duration int64) {
+// enableBastionMode enable bastion mode on server, marker is nil if enabling
+// failed and all changes were rolled back
+func enableBastionMode(duration int64, trigger *Trigger) (*BastionMarker, error) {
 	if knf.HasProp(SCRIPT_BEFORE) {
 		runScript(knf.GetS(SCRIPT_BEFORE))
 	}
 
 	log.Info("[IMPORTANT] Enabling bastion mode...")
 
-	err := createBastionMarker(duration)
+	txErr := runTransaction(TX_ENABLE, duration, trigger)
 
-	if err != nil {
-		log.Error(err.Error())
+	if txErr == ErrTxRolledBack {
+		return nil, txErr
 	}
 
-	log.Info("Disabling sshd service...")
-
-	err = disableService("sshd")
+	marker, err := getBastionMarkerInfo()
 
 	if err != nil {
-		log.Error(err.Error())
-	} else {
-		log.Info("sshd service disabled")
-	}
-
-	log.Info("Stopping sshd service...")
-
-	err = stopService("sshd")
-
-	if err != nil {
-		log.Error(err.Error())
-	} else {
-		log.Info("sshd service stopped")
-	}
-
-	log.Info("Enabling bastion service...")
-
-	err = enableService("bastion")
-
-	if err != nil {
-		log.Error(err.Error())
-	} else {
-		log.Info("bastion service enabled")
+		log.Error("Can't read bastion marker: %v", err)
+		now := time.Now().Unix()
+		marker = &BastionMarker{
+			Version:  MARKER_VERSION,
+			Started:  now,
+			Until:    now + duration,
+			Duration: duration,
+		}
 	}
 
 	if knf.HasProp(SCRIPT_IN) {
 		runScript(knf.GetS(SCRIPT_IN))
 	}
+
+	return marker, txErr
 }
 
-// enableBastionMode disable bastion mode on server
-func disableBastionMode() {
+// disableBastionMode disable bastion mode on server, if any action can't be
+// reverted marker and journal are kept
+func disableBastionMode() error {
 	if knf.HasProp(SCRIPT_OUT) {
 		runScript(knf.GetS(SCRIPT_OUT))
 	}
 
 	log.Info("[IMPORTANT] Disabling bastion mode...")
 
-	err := removeBastionMarker()
-
-	if err != nil {
-		log.Error(err.Error())
-	}
-
-	log.Info("Enabling sshd service...")
-
-	err = enableService("sshd")
-
-	if err != nil {
-		log.Error(err.Error())
-	} else {
-		log.Info("sshd service enabled")
-	}
-
-	log.Info("Starting sshd service...")
-
-	err = startService("sshd")
+	err := runTransaction(TX_DISABLE, 0, nil)
 
 	if err != nil {
-		log.Error(err.Error())
-	} else {
-		log.Info("sshd service started")
-	}
-
-	log.Info("Disabling bastion service...")
-
-	err = disableService("bastion")
-
-	if err != nil {
-		log.Error(err.Error())
-	} else {
-		log.Info("bastion service disabled")
+		return err
 	}
 
 	if knf.HasProp(SCRIPT_END) {
 		runScript(knf.GetS(SCRIPT_END))
 	}
 
-	// Shutdown Bastion when bastion mode disabled
-	log.Info("Bastion now is shutdown...")
-
-	shutdown(0)
+	return nil
 }
 
 // enableService enable service autostart
@@ -253,6 +121,25 @@ func startService(name string) error {
 	return startServiceBySysV(name)
 }
 
+// reloadService reload service configuration
+func reloadService(name string) error {
+	var cmd *exec.Cmd
+
+	if initsystem.Systemd() {
+		cmd = exec.Command("systemctl", "reload", name)
+	} else {
+		cmd = exec.Command("service", name, "reload")
+	}
+
+	err := cmd.Run()
+
+	if err != nil {
+		return fmt.Errorf("Can't reload %s service: %v", name, err)
+	}
+
+	return nil
+}
+
 // stopService stop service
 func stopService(name string) error {
 	if initsystem.Systemd() {
@@ -414,66 +301,17 @@ func stopServiceBySystemd(name string) error {
 	return fmt.Errorf("%s service still works after 15 sec", name)
 }
 
-// createBastionMarker create file with info about bastion mode
-func createBastionMarker(duration int64) error {
-	if isBastionMarkerExist() {
-		return nil
-	}
-
-	now := time.Now().Unix()
-
-	bastionMarker = &BastionMarker{now, now + duration}
-
-	err := jsonutil.Write(BASTION_MARKER, bastionMarker, 0600)
+// runScript run script with given environment variables
+func runScript(script string, env ...string) {
+	log.Info("Executing script '%s' ...", script)
 
-	if err != nil {
-		return fmt.Errorf("Can't encode bastion marker: %v", err)
-	}
-
-	return nil
-}
-
-// removeBastionMarker remove file with info about bastion mode
-func removeBastionMarker() error {
-	if !isBastionMarkerExist() {
-		return nil
-	}
+	cmd := exec.Command(script)
+	cmd.Env = append(os.Environ(), env...)
 
-	err := os.Remove(BASTION_MARKER)
+	err := cmd.Run()
 
 	if err != nil {
-		return fmt.Errorf("Can't remove bastion marker: %v", err)
-	}
-
-	return nil
-}
-
-// getBastionMarkerInfo read and decode bastion marker
-func getBastionMarkerInfo() (*BastionMarker, error) {
-	marker := &BastionMarker{}
-
-	err := jsonutil.Read(BASTION_MARKER, marker)
-
-	if err != nil {
-		return nil, err
-	}
-
-	return marker, nil
-}
-
-// isBastionMarkerExist return true if bastion marker file exist
-func isBastionMarkerExist() bool {
-	return fsutil.IsExist(BASTION_MARKER)
-}
-
-// runScript run script
-func runScript(script string) {
-	log.Info("Executing sctipt '%s' ...", script)
-
-	err := exec.Command("bash", "script").Start()
-
-	if err != nil {
-		log.Error("Script return error")
+		log.Error("Script return error: %v", err)
 	} else {
 		log.Info("Script successfully executed")
 	}
@@ -508,42 +346,3 @@ func isServiceStopped(name string) bool {
 
 	return false
 }
-
-// generateSecrets generate key, link and trigger path
-func generateSecrets() string {
-	key = passwd.GenPassword(32, passwd.STRENGTH_MEDIUM)
-
-	var link string
-
-	if knf.GetS(MAIN_URL) != "" {
-		link = knf.GetS(MAIN_URL)
-	} else {
-		ip := knf.GetS(SERVER_IP)
-
-		if ip == "" {
-			link = "http://" + netutil.GetIP()
-		} else {
-			link = "http://" + ip
-		}
-
-		port := knf.GetS(SERVER_PORT)
-
-		if port != "" && port != "80" {
-			link += ":" + port
-		}
-	}
-
-	if knf.GetS(MAIN_PATH) != "" {
-		path := knf.GetS(MAIN_PATH)
-		path = strings.TrimLeft(path, "/")
-		path = strings.TrimRight(path, "/")
-
-		link += "/" + path
-		bastionPath = "/" + path
-	}
-
-	link += "/" + key
-	bastionPath += "/" + key
-
-	return link
-}
@@ -0,0 +1,81 @@
+package daemon
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+//                                                                                    //
+//                         Copyright (c) 2022 ESSENTIAL KAOS                          //
+//      Apache License, Version 2.0 <https://www.apache.org/licenses/LICENSE-2.0>     //
+//                                                                                    //
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/essentialkaos/ek/v12/fsutil"
+	"github.com/essentialkaos/ek/v12/knf"
+	"github.com/essentialkaos/ek/v12/log"
+)
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// startCanaryWatcher starts watcher for canary files if any configured
+func startCanaryWatcher() error {
+	paths := strings.FieldsFunc(knf.GetS(CANARY_PATHS), isListSeparator)
+
+	if len(paths) == 0 {
+		return nil
+	}
+
+	err := watchCanaries(paths)
+
+	if err != nil {
+		return fmt.Errorf("Can't watch canary files: %v", err)
+	}
+
+	log.Info("Canary watcher started (%d paths)", len(paths))
+
+	return nil
+}
+
+// triggerCanary enables bastion mode due to access to canary file
+func triggerCanary(path string, pid int, exe string) {
+	actor := "unknown"
+
+	if pid > 0 {
+		actor = fmt.Sprintf("%s (PID: %d)", exe, pid)
+	}
+
+	log.Warn(
+		"[SUSPICIOUS] Access to canary %s by %s detected, enabling bastion mode...",
+		path, actor,
+	)
+
+	err := ctrl.Activate(&Trigger{
+		Source: "canary",
+		Actor:  actor,
+		Reason: "Access to canary " + path,
+	})
+
+	if err != nil {
+		log.Debug("Canary trigger ignored: %v", err)
+	}
+}
+
+// isLockdownInProgress returns true if bastion mode is enabled or enabling now
+func isLockdownInProgress() bool {
+	state := ctrl.State()
+	return state == STATE_ACTIVATING || state == STATE_ACTIVE
+}
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// validateCanaryPaths is knf validator for list of canary files
+func validateCanaryPaths(config *knf.Config, prop string, value interface{}) error {
+	for _, path := range strings.FieldsFunc(config.GetS(prop), isListSeparator) {
+		if !fsutil.IsExist(path) {
+			return fmt.Errorf("Canary %s doesn't exist", path)
+		}
+	}
+
+	return nil
+}
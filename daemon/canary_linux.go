@@ -0,0 +1,140 @@
+//go:build linux
+
+package daemon
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+//                                                                                    //
+//                         Copyright (c) 2022 ESSENTIAL KAOS                          //
+//      Apache License, Version 2.0 <https://www.apache.org/licenses/LICENSE-2.0>     //
+//                                                                                    //
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"unsafe"
+
+	"github.com/essentialkaos/ek/v12/log"
+)
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// CANARY_EVENTS is mask of inotify events for canary files
+const CANARY_EVENTS = syscall.IN_OPEN | syscall.IN_ACCESS | syscall.IN_MODIFY
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// watchCanaries adds inotify watches for canary files
+func watchCanaries(paths []string) error {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+
+	if err != nil {
+		return err
+	}
+
+	watches := make(map[int32]string)
+
+	for _, path := range paths {
+		wd, err := syscall.InotifyAddWatch(fd, path, CANARY_EVENTS)
+
+		if err != nil {
+			syscall.Close(fd)
+			return err
+		}
+
+		watches[int32(wd)] = path
+	}
+
+	go readCanaryEvents(fd, watches)
+
+	return nil
+}
+
+// readCanaryEvents reads inotify events and triggers bastion mode
+func readCanaryEvents(fd int, watches map[int32]string) {
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+
+	for {
+		n, err := syscall.Read(fd, buf)
+
+		if err != nil {
+			if err == syscall.EINTR {
+				continue
+			}
+
+			log.Error("Can't read canary events: %v", err)
+			return
+		}
+
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			path := watches[event.Wd]
+			nameStart := offset + syscall.SizeofInotifyEvent
+			offset = nameStart + int(event.Len)
+
+			if path == "" || event.Mask&CANARY_EVENTS == 0 || isLockdownInProgress() {
+				continue
+			}
+
+			if event.Len > 0 && offset <= n {
+				path = filepath.Join(path, string(trimNullBytes(buf[nameStart:offset])))
+			}
+
+			pid, exe := findFileAccessor(path)
+			triggerCanary(path, pid, exe)
+		}
+	}
+}
+
+// findFileAccessor returns PID and executable of process which has file open
+func findFileAccessor(path string) (int, string) {
+	procs, err := os.ReadDir("/proc")
+
+	if err != nil {
+		return -1, ""
+	}
+
+	self := os.Getpid()
+
+	for _, proc := range procs {
+		pid, err := strconv.Atoi(proc.Name())
+
+		if err != nil || pid == self {
+			continue
+		}
+
+		fdDir := filepath.Join("/proc", proc.Name(), "fd")
+		fds, err := os.ReadDir(fdDir)
+
+		if err != nil {
+			continue
+		}
+
+		for _, fd := range fds {
+			target, err := os.Readlink(filepath.Join(fdDir, fd.Name()))
+
+			if err != nil || target != path {
+				continue
+			}
+
+			exe, _ := os.Readlink(filepath.Join("/proc", proc.Name(), "exe"))
+
+			return pid, exe
+		}
+	}
+
+	return -1, ""
+}
+
+// trimNullBytes removes null padding from inotify event name
+func trimNullBytes(data []byte) []byte {
+	for i, b := range data {
+		if b == 0 {
+			return data[:i]
+		}
+	}
+
+	return data
+}
@@ -0,0 +1,490 @@
+package daemon
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+//                                                                                    //
+//                         Copyright (c) 2022 ESSENTIAL KAOS                          //
+//      Apache License, Version 2.0 <https://www.apache.org/licenses/LICENSE-2.0>     //
+//                                                                                    //
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/essentialkaos/ek/v12/fmtc"
+	"github.com/essentialkaos/ek/v12/fsutil"
+	"github.com/essentialkaos/ek/v12/initsystem"
+	"github.com/essentialkaos/ek/v12/knf"
+	"github.com/essentialkaos/ek/v12/options"
+	"github.com/essentialkaos/ek/v12/pid"
+)
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// Exit codes of configuration check
+const (
+	CHECK_OK       = 0 // No problems found
+	CHECK_ERRORS   = 1 // Configuration contains errors
+	CHECK_FAILED   = 2 // Configuration file can't be read
+	CHECK_WARNINGS = 3 // Configuration contains only warnings
+)
+
+// Problem severities
+const (
+	SEVERITY_ERROR   = "error"
+	SEVERITY_WARNING = "warning"
+)
+
+// Checks names
+const (
+	CHECK_READ        = "read"
+	CHECK_UNKNOWN_KEY = "unknown-key"
+	CHECK_VALIDATION  = "validation"
+	CHECK_SCRIPT      = "script"
+	CHECK_CONFLICT    = "conflict"
+	CHECK_PORT        = "port"
+	CHECK_SERVICE     = "service"
+)
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// ConfigCheck contains results of configuration check
+type ConfigCheck struct {
+	Config   string           `json:"config"`
+	Status   string           `json:"status"`
+	Problems []*ConfigProblem `json:"problems"`
+	Values   []*ConfigValue   `json:"values,omitempty"`
+}
+
+// ConfigProblem contains info about configuration problem
+type ConfigProblem struct {
+	Severity string `json:"severity"`
+	Check    string `json:"check"`
+	Property string `json:"property,omitempty"`
+	Message  string `json:"message"`
+}
+
+// ConfigValue contains effective value of property and its source
+type ConfigValue struct {
+	Property string `json:"property"`
+	Value    string `json:"value"`
+	Source   string `json:"source"`
+}
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// knownProps is list of all supported configuration properties
+var knownProps = []string{
+	MAIN_DURATION, MAIN_URL, MAIN_PATH, MAIN_MARKER_POLICY, MAIN_STATE_DIR,
+	MAIN_PID_DIR, MAIN_LEVEL, MAIN_PROFILE, MAIN_DRY_RUN, MAIN_INCLUDE,
+	SERVER_IP, SERVER_PORT, SERVER_NAME, SERVER_ALLOW, SERVER_TRUSTED_PROXIES,
+	SERVER_PROXY_PROTOCOL, SERVER_TRUST_LOOPBACK,
+	TRIGGER_METHODS, TRIGGER_CONFIRM,
+	PROTECTION_RATE, PROTECTION_MAX_FAILS, PROTECTION_FAILS_WINDOW,
+	PROTECTION_BAN_TIME, PROTECTION_LOCKDOWN, PROTECTION_LOCKDOWN_BANS,
+	PROTECTION_LOCKDOWN_WINDOW,
+	WATCHDOG_INTERVAL,
+	NOTIFY_URL,
+	AUTHLOG_ENABLED, AUTHLOG_SOURCE, AUTHLOG_ROOT_FAILS, AUTHLOG_ROOT_FAILS_WINDOW,
+	AUTHLOG_FAILS, AUTHLOG_FAILS_WINDOW, AUTHLOG_KNOWN_NETS,
+	RESTRICTED_USERS, RESTRICTED_NETS, RESTRICTED_KEYS, RESTRICTED_CONFIG_DIR,
+	HARDENING_NOLOGIN_MESSAGE, HARDENING_FIREWALL_ALLOW, HARDENING_LOCK_USERS,
+	CANARY_PATHS,
+	DEADMAN_ENABLED, DEADMAN_KEY, DEADMAN_TIMEOUT, DEADMAN_MAX_SKEW,
+	DECOY_ENABLED, DECOY_PORT, DECOY_BANNER,
+	LOG_DIR, LOG_FILE, LOG_PERMS, LOG_LEVEL, LOG_FORMAT, LOG_AUDIT, LOG_EVENTS,
+	SCRIPT_BEFORE, SCRIPT_IN, SCRIPT_OUT, SCRIPT_END, SCRIPT_DRIFT,
+}
+
+// dynamicSections is list of sections with user-defined properties
+var dynamicSections = []string{SCHEDULE_SECTION, PROFILES_SECTION}
+
+// scriptProps is list of properties with paths to hook scripts
+var scriptProps = []string{SCRIPT_BEFORE, SCRIPT_IN, SCRIPT_OUT, SCRIPT_END, SCRIPT_DRIFT}
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// checkConfig checks configuration file, prints report and exits with
+// check exit code
+func checkConfig() {
+	check := &ConfigCheck{Config: options.GetS(OPT_CONFIG)}
+	err := loadGlobalConfig(check.Config)
+
+	if err != nil {
+		check.Add(SEVERITY_ERROR, CHECK_READ, "", err.Error())
+	} else {
+		check.Values = getConfigValuesInfo()
+
+		checkUnknownProps(check)
+		checkConfigValues(check)
+		checkScripts(check)
+		checkConflicts(check)
+		checkServerPort(check)
+		checkServices(check)
+	}
+
+	code := check.ExitCode()
+
+	if options.GetB(OPT_JSON) {
+		printCheckJSON(check)
+	} else {
+		printCheck(check)
+	}
+
+	os.Exit(code)
+}
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// Add adds problem to check results
+func (c *ConfigCheck) Add(severity, check, prop, message string) {
+	c.Problems = append(c.Problems, &ConfigProblem{severity, check, prop, message})
+}
+
+// Count returns number of problems with given severity
+func (c *ConfigCheck) Count(severity string) int {
+	var result int
+
+	for _, p := range c.Problems {
+		if p.Severity == severity {
+			result++
+		}
+	}
+
+	return result
+}
+
+// ExitCode returns exit code for check results and sets check status
+func (c *ConfigCheck) ExitCode() int {
+	switch {
+	case len(c.Problems) != 0 && c.Problems[0].Check == CHECK_READ:
+		c.Status = "failed"
+		return CHECK_FAILED
+	case c.Count(SEVERITY_ERROR) != 0:
+		c.Status = "error"
+		return CHECK_ERRORS
+	case c.Count(SEVERITY_WARNING) != 0:
+		c.Status = "warning"
+		return CHECK_WARNINGS
+	}
+
+	c.Status = "ok"
+
+	return CHECK_OK
+}
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// checkUnknownProps checks configuration for unknown sections and properties
+func checkUnknownProps(check *ConfigCheck) {
+	known := make(map[string]bool)
+
+	for _, prop := range knownProps {
+		known[prop] = true
+	}
+
+	for _, section := range knf.Sections() {
+		if isDynamicSection(section) {
+			continue
+		}
+
+		if !isKnownSection(section) {
+			check.Add(SEVERITY_WARNING, CHECK_UNKNOWN_KEY, section, fmt.Sprintf("Unknown section [%s]", section))
+			continue
+		}
+
+		for _, prop := range knf.Props(section) {
+			if !known[section+":"+prop] {
+				check.Add(
+					SEVERITY_WARNING, CHECK_UNKNOWN_KEY, section+":"+prop,
+					fmt.Sprintf("Unknown property %s:%s in %s", section, prop, configSources[section+":"+prop]),
+				)
+			}
+		}
+	}
+}
+
+// checkConfigValues runs configuration validators
+func checkConfigValues(check *ConfigCheck) {
+	for _, v := range getConfigValidators(knf.Props) {
+		// Scripts are checked separately with more details
+		if isScriptProp(v.Property) {
+			continue
+		}
+
+		// Validators are run one by one, so every problem is linked to property
+		for _, err := range knf.Validate([]*knf.Validator{v}) {
+			check.Add(SEVERITY_ERROR, CHECK_VALIDATION, v.Property, err.Error())
+		}
+	}
+}
+
+// checkScripts checks that hook scripts exist and can be executed by root
+func checkScripts(check *ConfigCheck) {
+	for _, prop := range scriptProps {
+		if knf.GetS(prop) == "" {
+			continue
+		}
+
+		err := checkScript(knf.GetS(prop))
+
+		if err != nil {
+			check.Add(SEVERITY_ERROR, CHECK_SCRIPT, prop, err.Error())
+		}
+	}
+}
+
+// checkConflicts checks configuration for conflicting options
+func checkConflicts(check *ConfigCheck) {
+	if knf.GetS(MAIN_LEVEL) != "" && knf.GetS(MAIN_PROFILE) != "" {
+		check.Add(
+			SEVERITY_WARNING, CHECK_CONFLICT, MAIN_LEVEL,
+			fmt.Sprintf("Property %s is ignored because %s is set", MAIN_LEVEL, MAIN_PROFILE),
+		)
+	}
+
+	if knf.GetB(MAIN_DRY_RUN) {
+		check.Add(
+			SEVERITY_WARNING, CHECK_CONFLICT, MAIN_DRY_RUN,
+			"Dry-run mode is enabled, bastion mode will never be enabled",
+		)
+	}
+
+	for _, profile := range getProfiles() {
+		if profile.HasAction(ACTION_RESTRICT_SSHD) && profile.HasAction(ACTION_STOP_SSHD) {
+			check.Add(
+				SEVERITY_WARNING, CHECK_CONFLICT, PROFILES_SECTION+":"+profile.Name,
+				fmt.Sprintf(
+					"Profile %s contains both %s and %s actions",
+					profile.Name, ACTION_RESTRICT_SSHD, ACTION_STOP_SSHD,
+				),
+			)
+		}
+	}
+
+	if !knf.GetB(DECOY_ENABLED) {
+		return
+	}
+
+	if knf.GetS(DECOY_PORT, "22") == knf.GetS(SERVER_PORT) {
+		check.Add(
+			SEVERITY_ERROR, CHECK_CONFLICT, DECOY_PORT,
+			fmt.Sprintf("Properties %s and %s have the same value", DECOY_PORT, SERVER_PORT),
+		)
+	}
+
+	profile, err := getProfile("")
+
+	if err == nil && !profile.HasAction(ACTION_STOP_SSHD) {
+		check.Add(
+			SEVERITY_WARNING, CHECK_CONFLICT, DECOY_ENABLED,
+			fmt.Sprintf("Decoy listener won't be started with %s profile because sshd isn't stopped", profile.Name),
+		)
+	}
+}
+
+// checkServerPort checks that HTTP server port is not used by another process
+func checkServerPort(check *ConfigCheck) {
+	if knf.GetS(SERVER_PORT) == "" {
+		return
+	}
+
+	pid.Dir = knf.GetS(MAIN_PID_DIR, "/var/run")
+
+	// Port is used by running daemon
+	if pid.Get(PID_FILE) != -1 {
+		return
+	}
+
+	addr := net.JoinHostPort(knf.GetS(SERVER_IP), knf.GetS(SERVER_PORT))
+	ln, err := net.Listen("tcp", addr)
+
+	if err != nil {
+		check.Add(SEVERITY_ERROR, CHECK_PORT, SERVER_PORT, fmt.Sprintf("Can't listen %s: %v", addr, err))
+		return
+	}
+
+	ln.Close()
+}
+
+// checkServices checks that services used by profiles exist in init system
+func checkServices(check *ConfigCheck) {
+	checked := make(map[string]bool)
+
+	for _, profile := range getProfiles() {
+		for _, action := range profile.Actions {
+			service := getActionService(action)
+
+			if service == "" || checked[service] {
+				continue
+			}
+
+			checked[service] = true
+
+			if !initsystem.IsPresent(service) {
+				check.Add(
+					SEVERITY_ERROR, CHECK_SERVICE, "",
+					fmt.Sprintf("Service %s used by %s profile doesn't exist", service, profile.Name),
+				)
+			}
+		}
+	}
+}
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// printCheck prints check results to console
+func printCheck(check *ConfigCheck) {
+	fmtc.Printf("Configuration file: {*}%s{!}\n\n", check.Config)
+
+	if len(check.Values) != 0 {
+		for _, v := range check.Values {
+			fmtc.Printf("  %-28s %s {s}(%s){!}\n", v.Property, v.Value, v.Source)
+		}
+
+		fmtc.NewLine()
+	}
+
+	for _, p := range check.Problems {
+		prop := ""
+
+		if p.Property != "" {
+			prop = " {s}(" + p.Property + "){!}"
+		}
+
+		switch p.Severity {
+		case SEVERITY_ERROR:
+			fmtc.Printf("  {r}ERROR{!}   %-12s %s"+prop+"\n", p.Check, p.Message)
+		default:
+			fmtc.Printf("  {y}WARNING{!} %-12s %s"+prop+"\n", p.Check, p.Message)
+		}
+	}
+
+	if len(check.Problems) != 0 {
+		fmtc.NewLine()
+	}
+
+	switch check.Status {
+	case "ok":
+		fmtc.Println("{g}Configuration is valid{!}")
+	case "failed":
+		fmtc.Println("{r}Configuration file can't be read{!}")
+	default:
+		fmtc.Printf(
+			"{y}Found %d errors and %d warnings{!}\n",
+			check.Count(SEVERITY_ERROR), check.Count(SEVERITY_WARNING),
+		)
+	}
+}
+
+// printCheckJSON prints check results in JSON format
+func printCheckJSON(check *ConfigCheck) {
+	if check.Problems == nil {
+		check.Problems = []*ConfigProblem{}
+	}
+
+	data, _ := json.MarshalIndent(check, "", "  ")
+
+	fmt.Println(string(data))
+}
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// getConfigValuesInfo returns effective values of all properties with
+// their sources
+func getConfigValuesInfo() []*ConfigValue {
+	var result []*ConfigValue
+
+	for _, section := range knf.Sections() {
+		for _, prop := range knf.Props(section) {
+			name := section + ":" + prop
+			value := knf.GetS(name)
+
+			if isSecretProp(name) {
+				value = maskSecret(value)
+			}
+
+			result = append(result, &ConfigValue{name, value, configSources[name]})
+		}
+	}
+
+	return result
+}
+
+// checkScript checks that script exists and is safe to execute by root
+func checkScript(file string) error {
+	if !fsutil.IsExist(file) {
+		return fmt.Errorf("Script %s doesn't exist", file)
+	}
+
+	if !fsutil.IsRegular(file) {
+		return fmt.Errorf("Script %s is not a regular file", file)
+	}
+
+	uid, _, err := fsutil.GetOwner(file)
+
+	if err != nil {
+		return fmt.Errorf("Can't get owner of script %s: %v", file, err)
+	}
+
+	mode := fsutil.GetMode(file)
+
+	switch {
+	case uid != 0:
+		return fmt.Errorf("Script %s must be owned by root", file)
+	case mode&0111 == 0:
+		return fmt.Errorf("Script %s is not executable", file)
+	case mode&0022 != 0:
+		return fmt.Errorf("Script %s is writable by group or others", file)
+	}
+
+	return nil
+}
+
+// getActionService returns name of service changed by action
+func getActionService(action string) string {
+	switch action {
+	case ACTION_DISABLE_SSHD, ACTION_STOP_SSHD, ACTION_RESTRICT_SSHD:
+		return "sshd"
+	case ACTION_ENABLE_BASTION:
+		return "bastion"
+	}
+
+	return ""
+}
+
+// isKnownSection returns true if at least one known property is in section
+func isKnownSection(section string) bool {
+	for _, prop := range knownProps {
+		if strings.HasPrefix(prop, section+":") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isDynamicSection returns true if section contains user-defined properties
+func isDynamicSection(section string) bool {
+	for _, s := range dynamicSections {
+		if s == section {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isScriptProp returns true if property contains path to hook script
+func isScriptProp(prop string) bool {
+	for _, p := range scriptProps {
+		if p == prop {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,102 @@
+package daemon
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+//                                                                                    //
+//                         Copyright (c) 2022 ESSENTIAL KAOS                          //
+//      Apache License, Version 2.0 <https://www.apache.org/licenses/LICENSE-2.0>     //
+//                                                                                    //
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+import (
+	"testing"
+)
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// STOCK_CONFIG is path to configuration file shipped with package
+const STOCK_CONFIG = "../common/bastion.knf"
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+func TestCheckStockConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		prop string
+		val  string
+	}{
+		{"stock", "", ""},
+		{"duration with unit", MAIN_DURATION, "1d"},
+		{"port with unit", SERVER_PORT, "17491tcp"},
+		{"ban time with unit", PROTECTION_BAN_TIME, "1h"},
+		{"deadman timeout with unit", DEADMAN_TIMEOUT, "60m"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setStockConfigEnv(t)
+
+			if tt.prop != "" {
+				t.Setenv(getConfigEnvName(tt.prop), tt.val)
+			}
+
+			check := &ConfigCheck{Config: STOCK_CONFIG}
+			err := loadGlobalConfig(check.Config)
+
+			if err != nil {
+				t.Fatalf("Can't load stock configuration: %v", err)
+			}
+
+			checkUnknownProps(check)
+			checkConfigValues(check)
+			checkScripts(check)
+			checkConflicts(check)
+
+			var isPropErr bool
+
+			for _, p := range check.Problems {
+				switch {
+				case p.Check == CHECK_UNKNOWN_KEY:
+					t.Errorf("Unexpected unknown property: %s", p.Message)
+				case p.Severity != SEVERITY_ERROR:
+					continue
+				case tt.prop != "" && p.Check == CHECK_VALIDATION && p.Property == tt.prop:
+					isPropErr = true
+				default:
+					t.Errorf("Unexpected error %s (%s): %s", p.Check, p.Property, p.Message)
+				}
+			}
+
+			if tt.prop != "" && !isPropErr {
+				t.Fatalf("Configuration must contain validation error for %s", tt.prop)
+			}
+		})
+	}
+}
+
+func TestStockConfigScriptProps(t *testing.T) {
+	setStockConfigEnv(t)
+
+	err := loadGlobalConfig(STOCK_CONFIG)
+
+	if err != nil {
+		t.Fatalf("Can't load stock configuration: %v", err)
+	}
+
+	for _, prop := range scriptProps {
+		if _, ok := configSources[prop]; !ok {
+			t.Errorf("Property %s is not present in stock configuration", prop)
+		}
+	}
+}
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// setStockConfigEnv redirects system paths from stock configuration to
+// temporary directories
+func setStockConfigEnv(t *testing.T) {
+	t.Setenv(getConfigEnvName(MAIN_INCLUDE), "")
+
+	for _, prop := range []string{MAIN_STATE_DIR, MAIN_PID_DIR, LOG_DIR, RESTRICTED_CONFIG_DIR} {
+		t.Setenv(getConfigEnvName(prop), t.TempDir())
+	}
+}
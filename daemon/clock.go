@@ -0,0 +1,182 @@
+package daemon
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+//                                                                                    //
+//                         Copyright (c) 2022 ESSENTIAL KAOS                          //
+//      Apache License, Version 2.0 <https://www.apache.org/licenses/LICENSE-2.0>     //
+//                                                                                    //
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/essentialkaos/ek/v12/log"
+	"github.com/essentialkaos/ek/v12/timeutil"
+)
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// MAX_CLOCK_DRIFT is maximum difference between wall clock and monotonic clock
+// which is not treated as clock jump
+const MAX_CLOCK_DRIFT = 30 * time.Second
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// lockdownClock tracks elapsed lockdown time using monotonic clock
+type lockdownClock struct {
+	duration int64     // Lockdown duration in seconds
+	base     int64     // Elapsed time before start in seconds
+	start    time.Time // Start time with monotonic reading
+	last     time.Time // Last check time with monotonic reading
+	mx       sync.Mutex
+}
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// newLockdownClock creates new clock using info from marker
+func newLockdownClock(marker *BastionMarker) (*lockdownClock, error) {
+	if marker == nil {
+		return nil, fmt.Errorf("Bastion marker is empty")
+	}
+
+	now := time.Now()
+
+	duration := marker.Duration
+
+	if duration == 0 {
+		duration = marker.Until - marker.Started
+	}
+
+	return &lockdownClock{
+		duration: duration,
+		base:     getElapsedSinceCheckpoint(marker),
+		start:    now,
+		last:     now,
+	}, nil
+}
+
+// Elapsed returns elapsed lockdown time in seconds
+func (c *lockdownClock) Elapsed() int64 {
+	return c.base + int64(time.Since(c.start)/time.Second)
+}
+
+// Remaining returns remaining lockdown time in seconds
+func (c *lockdownClock) Remaining() int64 {
+	remaining := c.duration - c.Elapsed()
+
+	if remaining < 0 {
+		return 0
+	}
+
+	return remaining
+}
+
+// CheckJump checks wall clock for jumps since last check
+func (c *lockdownClock) CheckJump() {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	now := time.Now()
+	monoDelta := now.Sub(c.last)
+	wallDelta := now.Round(0).Sub(c.last.Round(0))
+	jump := wallDelta - monoDelta
+
+	c.last = now
+
+	if jump > -MAX_CLOCK_DRIFT && jump < MAX_CLOCK_DRIFT {
+		return
+	}
+
+	log.Warn(
+		"[SUSPICIOUS] System clock jump detected (%s %s), lockdown deadline is not affected",
+		timeutil.PrettyDuration(absDuration(jump)), getJumpDirection(jump),
+	)
+}
+
+// Checkpoint updates marker with elapsed time and boot info
+func (c *lockdownClock) Checkpoint(marker *BastionMarker) {
+	marker.Elapsed = c.Elapsed()
+	marker.Until = time.Now().Unix() + c.Remaining()
+	marker.BootID = getBootID()
+	marker.Uptime = getUptime()
+}
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// getElapsedSinceCheckpoint returns elapsed lockdown time using info about
+// last checkpoint from marker
+func getElapsedSinceCheckpoint(marker *BastionMarker) int64 {
+	uptime := getUptime()
+
+	if marker.BootID == "" || uptime < 0 {
+		return marker.Elapsed
+	}
+
+	if marker.BootID == getBootID() {
+		if uptime < marker.Uptime {
+			return marker.Elapsed
+		}
+
+		return marker.Elapsed + (uptime - marker.Uptime)
+	}
+
+	// System was rebooted, time when system was down is not counted
+	return marker.Elapsed + uptime
+}
+
+// getBootID returns current boot ID
+func getBootID() string {
+	data, err := os.ReadFile("/proc/sys/kernel/random/boot_id")
+
+	if err != nil {
+		return ""
+	}
+
+	return strings.TrimSpace(string(data))
+}
+
+// getUptime returns system uptime in seconds
+func getUptime() int64 {
+	data, err := os.ReadFile("/proc/uptime")
+
+	if err != nil {
+		return -1
+	}
+
+	fields := strings.Fields(string(data))
+
+	if len(fields) == 0 {
+		return -1
+	}
+
+	uptime, err := strconv.ParseFloat(fields[0], 64)
+
+	if err != nil {
+		return -1
+	}
+
+	return int64(uptime)
+}
+
+// absDuration returns absolute value of duration
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+
+	return d
+}
+
+// getJumpDirection returns direction of clock jump
+func getJumpDirection(d time.Duration) string {
+	if d < 0 {
+		return "backward"
+	}
+
+	return "forward"
+}
@@ -0,0 +1,298 @@
+package daemon
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+//                                                                                    //
+//                         Copyright (c) 2022 ESSENTIAL KAOS                          //
+//      Apache License, Version 2.0 <https://www.apache.org/licenses/LICENSE-2.0>     //
+//                                                                                    //
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/essentialkaos/ek/v12/knf"
+)
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// CONFIG_ENV_PREFIX is prefix of environment variables with configuration
+// overrides
+const CONFIG_ENV_PREFIX = "BASTION_"
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// mergedConfig is configuration merged from main file, included files and
+// environment variables
+type mergedConfig struct {
+	sections []string
+	props    map[string][]string // Ordered properties of sections
+	values   map[string]string   // Values of properties
+	sources  map[string]string   // Sources of values of properties
+}
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// configSources contains sources of values of current configuration
+var configSources map[string]string
+
+// envProps is list of properties which can be overridden by environment
+// variables, secrets and security options can be set only in files
+var envProps = []string{
+	MAIN_DURATION, MAIN_URL, MAIN_PATH, MAIN_MARKER_POLICY, MAIN_STATE_DIR,
+	MAIN_PID_DIR, MAIN_LEVEL, MAIN_PROFILE, MAIN_DRY_RUN, MAIN_INCLUDE,
+	SERVER_IP, SERVER_PORT, SERVER_NAME,
+	PROTECTION_RATE, PROTECTION_MAX_FAILS, PROTECTION_FAILS_WINDOW,
+	PROTECTION_BAN_TIME, PROTECTION_LOCKDOWN_BANS, PROTECTION_LOCKDOWN_WINDOW,
+	WATCHDOG_INTERVAL,
+	NOTIFY_URL,
+	AUTHLOG_SOURCE,
+	RESTRICTED_CONFIG_DIR,
+	DEADMAN_TIMEOUT, DEADMAN_MAX_SKEW,
+	LOG_DIR, LOG_FILE, LOG_PERMS, LOG_LEVEL, LOG_FORMAT, LOG_AUDIT, LOG_EVENTS,
+}
+
+// configFile is path to merged file of global configuration, file is removed
+// after reading and re-created only for reloading
+var configFile string
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// loadGlobalConfig reads configuration from all sources and sets it as global
+func loadGlobalConfig(file string) error {
+	file, sources, err := buildConfigFile(file)
+
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(file)
+
+	err = knf.Global(file)
+
+	if err != nil {
+		return err
+	}
+
+	configFile, configSources = file, sources
+
+	return nil
+}
+
+// buildConfigFile merges all configuration sources into temporary file and
+// returns path to it and sources of values
+func buildConfigFile(file string) (string, map[string]string, error) {
+	main, err := knf.Read(file)
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	merged := newMergedConfig()
+	err = merged.AddConfig(main, file)
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	pattern := main.GetS(MAIN_INCLUDE)
+
+	if value, ok := os.LookupEnv(getConfigEnvName(MAIN_INCLUDE)); ok {
+		pattern = value
+	}
+
+	includes, err := getIncludedFiles(pattern)
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	for _, include := range includes {
+		config, err := knf.Read(include)
+
+		if err != nil {
+			return "", nil, fmt.Errorf("Can't read %s: %v", include, err)
+		}
+
+		err = merged.AddConfig(config, include)
+
+		if err != nil {
+			return "", nil, err
+		}
+	}
+
+	err = merged.AddEnv()
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	tmp, err := os.CreateTemp("", "bastion-*.knf")
+
+	if err != nil {
+		return "", nil, fmt.Errorf("Can't create temporary configuration file: %v", err)
+	}
+
+	_, err = tmp.WriteString(merged.Render())
+	tmp.Close()
+
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", nil, fmt.Errorf("Can't write temporary configuration file: %v", err)
+	}
+
+	return tmp.Name(), merged.sources, nil
+}
+
+// getIncludedFiles returns lexically sorted list of included files
+func getIncludedFiles(pattern string) ([]string, error) {
+	if pattern == "" {
+		return nil, nil
+	}
+
+	files, err := filepath.Glob(pattern)
+
+	if err != nil {
+		return nil, fmt.Errorf("Can't list included configuration files: %v", err)
+	}
+
+	sort.Strings(files)
+
+	return files, nil
+}
+
+// readRawValues reads values of properties from configuration file without
+// expanding macros
+func readRawValues(file string) (map[string]string, error) {
+	data, err := os.ReadFile(file)
+
+	if err != nil {
+		return nil, fmt.Errorf("Can't read %s: %v", file, err)
+	}
+
+	var section string
+
+	result := make(map[string]string)
+
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+
+		switch {
+		case line == "", strings.HasPrefix(line, "#"):
+			continue
+		case strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]"):
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+
+		prop, value, ok := strings.Cut(line, ":")
+
+		if ok && section != "" {
+			result[section+":"+strings.TrimSpace(prop)] = strings.TrimSpace(value)
+		}
+	}
+
+	return result, nil
+}
+
+// getConfigEnvName returns name of environment variable with override for
+// given property
+func getConfigEnvName(prop string) string {
+	return CONFIG_ENV_PREFIX + strings.ToUpper(strings.NewReplacer(":", "_", "-", "_").Replace(prop))
+}
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// newMergedConfig creates new empty merged configuration
+func newMergedConfig() *mergedConfig {
+	return &mergedConfig{
+		props:   make(map[string][]string),
+		values:  make(map[string]string),
+		sources: make(map[string]string),
+	}
+}
+
+// AddConfig adds all properties from given configuration file
+func (m *mergedConfig) AddConfig(config *knf.Config, source string) error {
+	rawValues, err := readRawValues(source)
+
+	if err != nil {
+		return err
+	}
+
+	for _, section := range config.Sections() {
+		for _, prop := range config.Props(section) {
+			name := section + ":" + prop
+			value := config.GetS(name)
+
+			// Macros are kept as is and expanded while reading merged file, so
+			// overrides of referenced properties also change derived values
+			if rawValue := rawValues[name]; strings.Contains(rawValue, "{") {
+				value = rawValue
+			}
+
+			m.Set(section, prop, value, source)
+		}
+	}
+
+	return nil
+}
+
+// AddEnv adds overrides from environment variables
+func (m *mergedConfig) AddEnv() error {
+	for _, prop := range envProps {
+		name := getConfigEnvName(prop)
+		value, ok := os.LookupEnv(name)
+
+		if !ok {
+			continue
+		}
+
+		if strings.ContainsAny(value, "\r\n") {
+			return fmt.Errorf("Environment variable %s contains line break", name)
+		}
+
+		section, key, _ := strings.Cut(prop, ":")
+
+		m.Set(section, key, value, "env:"+name)
+	}
+
+	return nil
+}
+
+// Set sets property value
+func (m *mergedConfig) Set(section, prop, value, source string) {
+	name := section + ":" + prop
+
+	if _, ok := m.props[section]; !ok {
+		m.sections = append(m.sections, section)
+		m.props[section] = nil
+	}
+
+	if _, ok := m.values[name]; !ok {
+		m.props[section] = append(m.props[section], prop)
+	}
+
+	m.values[name] = value
+	m.sources[name] = source
+}
+
+// Render renders merged configuration in knf format
+func (m *mergedConfig) Render() string {
+	var result strings.Builder
+
+	for _, section := range m.sections {
+		result.WriteString("[" + section + "]\n")
+
+		for _, prop := range m.props[section] {
+			result.WriteString("  " + prop + ": " + m.values[section+":"+prop] + "\n")
+		}
+
+		result.WriteString("\n")
+	}
+
+	return result.String()
+}
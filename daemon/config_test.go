@@ -0,0 +1,182 @@
+package daemon
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+//                                                                                    //
+//                         Copyright (c) 2022 ESSENTIAL KAOS                          //
+//      Apache License, Version 2.0 <https://www.apache.org/licenses/LICENSE-2.0>     //
+//                                                                                    //
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/essentialkaos/ek/v12/knf"
+)
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+func TestMergedConfigRender(t *testing.T) {
+	type value struct{ section, prop, value string }
+
+	tests := []struct {
+		name   string
+		values []value
+		result string
+	}{
+		{"empty", nil, ""},
+		{
+			"single property",
+			[]value{{"main", "duration", "3600"}},
+			"[main]\n  duration: 3600\n\n",
+		},
+		{
+			"override keeps order",
+			[]value{
+				{"main", "duration", "3600"},
+				{"main", "profile", "standard"},
+				{"main", "duration", "7200"},
+			},
+			"[main]\n  duration: 7200\n  profile: standard\n\n",
+		},
+		{
+			"sections order",
+			[]value{
+				{"server", "port", "17491"},
+				{"main", "duration", "3600"},
+				{"server", "ip", "127.0.0.1"},
+			},
+			"[server]\n  port: 17491\n  ip: 127.0.0.1\n\n[main]\n  duration: 3600\n\n",
+		},
+		{
+			"macro",
+			[]value{
+				{"log", "dir", "/var/log/bastion"},
+				{"log", "file", "{log:dir}/bastion.log"},
+			},
+			"[log]\n  dir: /var/log/bastion\n  file: {log:dir}/bastion.log\n\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			merged := newMergedConfig()
+
+			for _, v := range tt.values {
+				merged.Set(v.section, v.prop, v.value, "test")
+			}
+
+			if merged.Render() != tt.result {
+				t.Fatalf("Unexpected result:\n%q\nexpected:\n%q", merged.Render(), tt.result)
+			}
+		})
+	}
+}
+
+func TestMergedConfigAddEnv(t *testing.T) {
+	tests := []struct {
+		name  string
+		prop  string
+		value string
+		isSet bool
+		isErr bool
+	}{
+		{"allowed", SERVER_PORT, "8080", true, false},
+		{"empty", LOG_AUDIT, "", true, false},
+		{"secret", DEADMAN_KEY, "0123456789abcdef", false, false},
+		{"confirm", TRIGGER_CONFIRM, "yes", false, false},
+		{"access", SERVER_ALLOW, "0.0.0.0/0", false, false},
+		{"line feed", LOG_LEVEL, "info\n[deadman]\n  key: x", false, true},
+		{"carriage return", LOG_LEVEL, "info\r", false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(getConfigEnvName(tt.prop), tt.value)
+
+			merged := newMergedConfig()
+			err := merged.AddEnv()
+
+			if tt.isErr != (err != nil) {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			_, isSet := merged.values[tt.prop]
+
+			if isSet != tt.isSet {
+				t.Fatalf("Property %s set: %t, expected: %t", tt.prop, isSet, tt.isSet)
+			}
+
+			if isSet && merged.sources[tt.prop] != "env:"+getConfigEnvName(tt.prop) {
+				t.Fatalf("Unexpected source %q", merged.sources[tt.prop])
+			}
+		})
+	}
+}
+
+func TestReadRawValues(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "bastion.knf")
+	data := "# comment\n[log]\n  # dir: /tmp\n  dir: /var/log/bastion\n" +
+		"  file: {log:dir}/bastion.log\n\n[server]\n  allow: 10.0.0.0/8\n  name:\n"
+
+	err := os.WriteFile(file, []byte(data), 0600)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	values, err := readRawValues(file)
+
+	if err != nil {
+		t.Fatalf("Can't read values: %v", err)
+	}
+
+	expected := map[string]string{
+		"log:dir":      "/var/log/bastion",
+		"log:file":     "{log:dir}/bastion.log",
+		"server:allow": "10.0.0.0/8",
+		"server:name":  "",
+	}
+
+	if len(values) != len(expected) {
+		t.Fatalf("Unexpected values: %v", values)
+	}
+
+	for prop, value := range expected {
+		if values[prop] != value {
+			t.Errorf("Property %s has value %q, expected %q", prop, values[prop], value)
+		}
+	}
+}
+
+func TestBuildConfigFileMacros(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "bastion.knf")
+	data := "[main]\n  include:\n\n[log]\n  dir: /var/log/bastion\n  file: {log:dir}/bastion.log\n"
+
+	err := os.WriteFile(file, []byte(data), 0600)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv(getConfigEnvName(LOG_DIR), "/srv/log")
+
+	merged, _, err := buildConfigFile(file)
+
+	if err != nil {
+		t.Fatalf("Can't build configuration: %v", err)
+	}
+
+	defer os.Remove(merged)
+
+	config, err := knf.Read(merged)
+
+	if err != nil {
+		t.Fatalf("Can't read merged configuration: %v", err)
+	}
+
+	if config.GetS(LOG_FILE) != "/srv/log/bastion.log" {
+		t.Fatalf("Unexpected value of %s: %q", LOG_FILE, config.GetS(LOG_FILE))
+	}
+}
@@ -0,0 +1,691 @@
+package daemon
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+//                                                                                    //
+//                         Copyright (c) 2022 ESSENTIAL KAOS                          //
+//      Apache License, Version 2.0 <https://www.apache.org/licenses/LICENSE-2.0>     //
+//                                                                                    //
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/essentialkaos/ek/v12/knf"
+	"github.com/essentialkaos/ek/v12/log"
+	"github.com/essentialkaos/ek/v12/timeutil"
+)
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// CHECKPOINT_INTERVAL is interval in minutes between saving elapsed lockdown
+// time to marker
+const CHECKPOINT_INTERVAL = 5
+
+// MAX_DURATION is maximum bastion mode duration in seconds
+const MAX_DURATION = 604800
+
+// DEACTIVATE_RETRY_DELAY is delay before next attempt to disable bastion mode
+// if some actions can't be reverted
+const DEACTIVATE_RETRY_DELAY = 5 * time.Minute
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// State is bastion state
+type State uint8
+
+const (
+	STATE_IDLE         State = iota // No bastion link issued
+	STATE_ARMED                     // Bastion link issued
+	STATE_ACTIVATING                // Bastion mode enabling in progress
+	STATE_ACTIVE                    // Bastion mode enabled
+	STATE_DEACTIVATING              // Bastion mode disabling in progress
+)
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// Controller controls bastion state
+type Controller struct {
+	state   State
+	secrets *Secrets
+	marker  *BastionMarker
+	clock   *lockdownClock
+	token   string
+
+	mx   sync.RWMutex // Guards state fields
+	txMx sync.Mutex   // Held while actions are applied or reverted
+}
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+var (
+	ErrLinkIssued    = errors.New("Bastion link already issued")
+	ErrInvalidToken  = errors.New("Bootstrap token is invalid")
+	ErrAlreadyActive = errors.New("Bastion mode already enabled or is enabling now")
+	ErrNotActive     = errors.New("Bastion mode is not enabled")
+	ErrInvalidSwitch = errors.New("Invalid state transition")
+	ErrNotEscalation = errors.New("Requested profile doesn't contain actions which are not applied yet")
+	ErrDryRun        = errors.New("Dry-run mode is enabled")
+)
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// ctrl is global bastion controller
+var ctrl = &Controller{}
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// String returns name of state
+func (s State) String() string {
+	switch s {
+	case STATE_IDLE:
+		return "idle"
+	case STATE_ARMED:
+		return "armed"
+	case STATE_ACTIVATING:
+		return "activating"
+	case STATE_ACTIVE:
+		return "active"
+	case STATE_DEACTIVATING:
+		return "deactivating"
+	}
+
+	return "unknown"
+}
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// State returns current state
+func (c *Controller) State() State {
+	c.mx.RLock()
+	defer c.mx.RUnlock()
+
+	return c.state
+}
+
+// Marker returns copy of current bastion marker
+func (c *Controller) Marker() *BastionMarker {
+	c.mx.RLock()
+	defer c.mx.RUnlock()
+
+	if c.marker == nil {
+		return nil
+	}
+
+	marker := *c.marker
+
+	return &marker
+}
+
+// Remaining returns remaining bastion mode time in seconds
+func (c *Controller) Remaining() int64 {
+	c.mx.RLock()
+	defer c.mx.RUnlock()
+
+	if c.clock == nil {
+		return 0
+	}
+
+	return c.clock.Remaining()
+}
+
+// IsTriggerPath returns true if given path is a path from bastion link
+func (c *Controller) IsTriggerPath(path string) bool {
+	c.mx.RLock()
+	defer c.mx.RUnlock()
+
+	return c.secrets.IsTriggerPath(path)
+}
+
+// IsLinkIssued returns true if bastion link already issued
+func (c *Controller) IsLinkIssued() bool {
+	c.mx.RLock()
+	defer c.mx.RUnlock()
+
+	return c.secrets != nil || c.state != STATE_IDLE
+}
+
+// SetSecrets sets secrets and one-time bootstrap token
+func (c *Controller) SetSecrets(secrets *Secrets, token string) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	c.secrets, c.token = secrets, token
+
+	switch {
+	case c.state == STATE_IDLE && secrets != nil:
+		c.state = STATE_ARMED
+	case c.state == STATE_ARMED && secrets == nil:
+		c.state = STATE_IDLE
+	}
+}
+
+// IssueLink generates new bastion link if it wasn't issued before
+func (c *Controller) IssueLink(token string, isLocal bool) (string, error) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	if c.secrets != nil || c.state != STATE_IDLE {
+		return "", ErrLinkIssued
+	}
+
+	if !isLocal && !isValidBootstrapToken(c.token, token) {
+		return "", ErrInvalidToken
+	}
+
+	secrets, link, err := generateSecrets()
+
+	if err != nil {
+		return "", err
+	}
+
+	err = removeBootstrapToken()
+
+	if err != nil {
+		log.Error(err.Error())
+	}
+
+	c.secrets, c.token = secrets, ""
+	c.state = STATE_ARMED
+
+	return link, nil
+}
+
+// Activate starts bastion mode enabling with configured duration
+func (c *Controller) Activate(trigger *Trigger) error {
+	return c.ActivateFor(trigger, knf.GetI64(MAIN_DURATION, 86400))
+}
+
+// ActivateFor starts bastion mode enabling with given duration in seconds
+func (c *Controller) ActivateFor(trigger *Trigger, duration int64) error {
+	if knf.GetB(MAIN_DRY_RUN) {
+		log.Warn(
+			"[IMPORTANT] Bastion mode activation requested in dry-run mode (source: %s, actor: %s, reason: %s)",
+			trigger.Source, trigger.Actor, trigger.Reason,
+		)
+		logPlan(trigger.Profile)
+		return ErrDryRun
+	}
+
+	err := c.switchState(STATE_ACTIVATING, STATE_IDLE, STATE_ARMED)
+
+	if err != nil {
+		return ErrAlreadyActive
+	}
+
+	if duration > MAX_DURATION {
+		log.Warn("Requested bastion mode duration (%ds) is limited to %ds", duration, MAX_DURATION)
+		duration = MAX_DURATION
+	}
+
+	logEvent(
+		EVENT_LEVEL_INFO,
+		&Event{
+			Event:    EVENT_TRIGGER_ACCEPTED,
+			Source:   trigger.Source,
+			Actor:    trigger.Actor,
+			Profile:  trigger.GetProfile(),
+			Duration: duration,
+		},
+		"Bastion mode activation requested (source: %s, actor: %s, reason: %s, profile: %s)",
+		trigger.Source, trigger.Actor, trigger.Reason, trigger.GetProfile(),
+	)
+
+	go c.activate(duration, trigger)
+
+	return nil
+}
+
+// Restore restores bastion mode after reboot or restart
+func (c *Controller) Restore() error {
+	err := c.switchState(STATE_ACTIVATING, STATE_IDLE, STATE_ARMED)
+
+	if err != nil {
+		return ErrAlreadyActive
+	}
+
+	log.Info("Found bastion marker, restoring bastion mode...")
+
+	marker, err := getBastionMarkerInfo()
+	policy := knf.GetS(MAIN_MARKER_POLICY, POLICY_FAIL_CLOSED)
+
+	switch {
+	case err == ErrMarkerInvalid && policy == POLICY_FAIL_OPEN:
+		log.Crit("[IMPORTANT] %v, disabling bastion mode due to %s policy", err, policy)
+		c.switchState(STATE_DEACTIVATING, STATE_ACTIVATING)
+		go c.deactivate()
+		return nil
+
+	case err == ErrMarkerInvalid:
+		log.Crit("[IMPORTANT] %v, renewing bastion mode due to %s policy", err, policy)
+		c.txMx.Lock()
+		marker, err = renewBastionMarker(
+			knf.GetI64(MAIN_DURATION, 86400),
+			&Trigger{Source: "marker-policy", Actor: APP, Reason: err.Error()},
+		)
+		c.txMx.Unlock()
+
+		if err != nil {
+			log.Crit("[IMPORTANT] Can't save renewed bastion marker, marker from memory will be used: %v", err)
+		}
+
+	case err != nil:
+		c.switchState(STATE_IDLE, STATE_ACTIVATING)
+		return fmt.Errorf("Can't restore bastion mode: %v", err)
+	}
+
+	if marker == nil {
+		c.switchState(STATE_IDLE, STATE_ACTIVATING)
+		return fmt.Errorf("Can't restore bastion mode: marker is empty")
+	}
+
+	c.txMx.Lock()
+	restoreBastionMode(marker)
+	c.txMx.Unlock()
+
+	// Actions can add info to marker while restoring
+	if m, err := getBastionMarkerInfo(); err == nil {
+		marker = m
+	}
+
+	logEvent(
+		EVENT_LEVEL_WARN,
+		&Event{
+			Event:    EVENT_MODE_RESTORE,
+			Source:   marker.Source,
+			Actor:    marker.Actor,
+			Profile:  marker.Profile,
+			Duration: marker.Duration,
+		},
+		"[IMPORTANT] Bastion mode restored (profile: %s)", marker.Profile,
+	)
+
+	sshDecoy.Start(marker)
+
+	c.mx.Lock()
+	c.marker, c.state = marker, STATE_ACTIVE
+	c.mx.Unlock()
+
+	go c.wait()
+
+	return nil
+}
+
+// Deactivate starts bastion mode disabling
+func (c *Controller) Deactivate() error {
+	err := c.switchState(STATE_DEACTIVATING, STATE_ACTIVE)
+
+	if err != nil {
+		return ErrNotActive
+	}
+
+	go c.deactivate()
+
+	return nil
+}
+
+// Escalate applies actions of harder profile while bastion mode is enabled,
+// profile is harder if it contains actions which are not applied yet
+func (c *Controller) Escalate(name, actor string) error {
+	profile, err := getProfile(name)
+
+	if err != nil {
+		return err
+	}
+
+	actions, err := getProfileActions(profile.Name)
+
+	if err != nil {
+		return err
+	}
+
+	if knf.GetB(MAIN_DRY_RUN) {
+		log.Warn("[IMPORTANT] Escalation to %s profile requested in dry-run mode (actor: %s)", profile.Name, actor)
+		logPlan(profile.Name)
+		return ErrDryRun
+	}
+
+	c.txMx.Lock()
+	defer c.txMx.Unlock()
+
+	if c.State() != STATE_ACTIVE {
+		return ErrNotActive
+	}
+
+	current := c.Marker()
+
+	if !isHarderProfile(profile, current) {
+		return ErrNotEscalation
+	}
+
+	logEvent(
+		EVENT_LEVEL_WARN,
+		&Event{Event: EVENT_MODE_ESCALATE, Actor: actor, Profile: profile.Name},
+		"[IMPORTANT] Escalating bastion mode from %s to %s profile (actor: %s)",
+		current.Profile, profile.Name, actor,
+	)
+
+	for _, action := range actions {
+		if current.GetAction(action.Name) != nil {
+			continue
+		}
+
+		err = applyAction(action)
+
+		if err != nil {
+			log.Error("Can't apply action %s: %v", action.Name, err)
+		}
+	}
+
+	marker, err := getBastionMarkerInfo()
+
+	if err != nil {
+		return fmt.Errorf("Can't update bastion marker: %v", err)
+	}
+
+	c.mx.Lock()
+
+	marker.Profile = profile.Name
+
+	if c.clock != nil {
+		c.clock.Checkpoint(marker)
+	}
+
+	err = saveBastionMarker(marker)
+
+	if err == nil {
+		c.marker = marker
+	}
+
+	c.mx.Unlock()
+
+	if err != nil {
+		return fmt.Errorf("Can't update bastion marker: %v", err)
+	}
+
+	sshDecoy.Start(marker)
+
+	log.Info("Bastion mode escalated to %s profile", profile.Name)
+
+	return nil
+}
+
+// Recover ends bastion mode using break-glass recovery code
+func (c *Controller) Recover(code, actor string) error {
+	if c.State() != STATE_ACTIVE {
+		return ErrNotActive
+	}
+
+	num, err := checkRecoveryCode(code)
+
+	switch err {
+	case nil:
+		// code is valid
+	case ErrRecoveryCodeSpent:
+		logEvent(
+			EVENT_LEVEL_WARN,
+			&Event{Event: EVENT_RECOVERY_FAILED, Actor: actor, Error: err.Error()},
+			"[SUSPICIOUS] Attempt to reuse spent recovery code #%d by %s", num, actor,
+		)
+		return err
+	default:
+		logEvent(
+			EVENT_LEVEL_WARN,
+			&Event{Event: EVENT_RECOVERY_FAILED, Actor: actor, Error: err.Error()},
+			"[SUSPICIOUS] Recovery attempt by %s failed: %v", actor, err,
+		)
+		return err
+	}
+
+	err = c.Deactivate()
+
+	if err != nil {
+		return err
+	}
+
+	// Code is spent only if disabling is started, so it isn't lost if bastion
+	// mode is disabled by another request at the same time
+	err = spendRecoveryCode(code, actor)
+
+	if err != nil {
+		log.Crit("[IMPORTANT] Can't spend recovery code #%d: %v", num, err)
+	}
+
+	logEvent(
+		EVENT_LEVEL_WARN,
+		&Event{Event: EVENT_RECOVERY_USED, Actor: actor},
+		"[IMPORTANT] Recovery code #%d used by %s (%d codes left), disabling bastion mode...",
+		num, actor, getUnspentRecoveryCodesNum(),
+	)
+
+	return nil
+}
+
+// Shutdown waits until current transition is finished and stops daemon
+func (c *Controller) Shutdown(code int) {
+	c.txMx.Lock()
+
+	if c.State() == STATE_ACTIVE {
+		c.checkpoint()
+	}
+
+	shutdown(code)
+}
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// activate enables bastion mode and waits for its end
+func (c *Controller) activate(duration int64, trigger *Trigger) {
+	c.txMx.Lock()
+	marker, err := enableBastionMode(duration, trigger)
+	c.txMx.Unlock()
+
+	if marker == nil {
+		log.Crit("[IMPORTANT] %v", err)
+		c.reset()
+		return
+	}
+
+	if err != nil {
+		// Some actions can't be reverted, so server stays in bastion mode
+		log.Crit("[IMPORTANT] Bastion mode enabled with errors: %v", err)
+	}
+
+	logEvent(
+		EVENT_LEVEL_WARN,
+		&Event{
+			Event:    EVENT_MODE_ENTER,
+			Source:   marker.Source,
+			Actor:    marker.Actor,
+			Profile:  marker.Profile,
+			Duration: marker.Duration,
+		},
+		"[IMPORTANT] Bastion mode enabled (profile: %s)", marker.Profile,
+	)
+
+	sshDecoy.Start(marker)
+
+	c.mx.Lock()
+	c.marker, c.state = marker, STATE_ACTIVE
+	c.mx.Unlock()
+
+	c.wait()
+}
+
+// deactivate disables bastion mode, daemon keeps working, so scheduler and
+// triggers can enable bastion mode again
+func (c *Controller) deactivate() {
+	// Decoy must free SSH port before sshd start
+	sshDecoy.Stop()
+
+	marker := c.Marker()
+
+	c.txMx.Lock()
+	err := disableBastionMode()
+	c.txMx.Unlock()
+
+	if err != nil {
+		log.Crit(
+			"[IMPORTANT] Can't disable bastion mode, it is kept till next attempt in %s: %v",
+			timeutil.PrettyDuration(DEACTIVATE_RETRY_DELAY), err,
+		)
+
+		c.switchState(STATE_ACTIVE, STATE_DEACTIVATING)
+		sshDecoy.Start(marker)
+		time.AfterFunc(DEACTIVATE_RETRY_DELAY, func() { c.Deactivate() })
+
+		return
+	}
+
+	event := &Event{Event: EVENT_MODE_EXIT}
+
+	if marker != nil {
+		event.Source, event.Actor, event.Profile = marker.Source, marker.Actor, marker.Profile
+		event.Duration = time.Now().Unix() - marker.Started
+	}
+
+	logEvent(EVENT_LEVEL_WARN, event, "[IMPORTANT] Bastion mode disabled")
+
+	c.reset()
+
+	deadman.Rearm()
+
+	log.Info("Bastion mode is over, daemon keeps working")
+}
+
+// wait waits until end of bastion mode
+func (c *Controller) wait() {
+	var count int
+
+	clock, err := newLockdownClock(c.Marker())
+
+	if err != nil {
+		// Bastion mode is kept till recovery, it is safer than ending it
+		log.Crit("[IMPORTANT] Can't track lockdown deadline, use recovery code to disable bastion mode: %v", err)
+		return
+	}
+
+	c.mx.Lock()
+	c.clock = clock
+	c.mx.Unlock()
+
+	go c.watch()
+
+	log.Info(
+		"Server will be in bastion mode till %s",
+		timeutil.Format(time.Now().Add(time.Duration(clock.Remaining())*time.Second), "%Y/%m/%d %H:%M"),
+	)
+
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if c.State() != STATE_ACTIVE {
+			return
+		}
+
+		clock.CheckJump()
+
+		if clock.Remaining() <= 0 {
+			break
+		}
+
+		count++
+
+		if count%CHECKPOINT_INTERVAL == 0 {
+			// Actions can update marker on disk, so checkpoint must not be
+			// saved while they are applied
+			c.txMx.Lock()
+			c.checkpoint()
+			c.txMx.Unlock()
+		}
+
+		if count%15 != 0 {
+			continue
+		}
+
+		log.Info(
+			"%s till exit from bastion mode",
+			timeutil.PrettyDuration(clock.Remaining()),
+		)
+	}
+
+	c.Deactivate()
+}
+
+// watch periodically checks applied actions and re-applies drifted ones
+func (c *Controller) watch() {
+	interval := knf.GetI(WATCHDOG_INTERVAL, 60)
+
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		c.txMx.Lock()
+
+		if c.State() != STATE_ACTIVE {
+			c.txMx.Unlock()
+			return
+		}
+
+		enforceActions(c.Marker())
+
+		c.txMx.Unlock()
+	}
+}
+
+// checkpoint saves elapsed lockdown time to marker
+func (c *Controller) checkpoint() {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	if c.clock == nil || c.marker == nil {
+		return
+	}
+
+	// Actions re-applied by watchdog can add info to marker on disk
+	if m, err := getBastionMarkerInfo(); err == nil {
+		c.marker.Actions, c.marker.Accounts = m.Actions, m.Accounts
+	}
+
+	c.clock.Checkpoint(c.marker)
+
+	err := saveBastionMarker(c.marker)
+
+	if err != nil {
+		log.Error("Can't save checkpoint: %v", err)
+	}
+}
+
+// reset resets state after end of bastion mode or failed enabling
+func (c *Controller) reset() {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	c.marker, c.clock, c.state = nil, nil, STATE_IDLE
+
+	if c.secrets != nil {
+		c.state = STATE_ARMED
+	}
+}
+
+// switchState switches state to given if current state is one of allowed
+func (c *Controller) switchState(to State, from ...State) error {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	for _, s := range from {
+		if c.state == s {
+			c.state = to
+			return nil
+		}
+	}
+
+	return ErrInvalidSwitch
+}
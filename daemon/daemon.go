@@ -8,8 +8,12 @@ package daemon
 // ////////////////////////////////////////////////////////////////////////////////// //
 
 import (
+	"errors"
+	"fmt"
 	"os"
 	"runtime"
+	"strings"
+	"syscall"
 
 	"github.com/essentialkaos/ek/v12/fmtc"
 	"github.com/essentialkaos/ek/v12/knf"
@@ -35,30 +39,101 @@ const (
 
 // Daemon info
 const (
-	MAIN_DURATION = "main:duration"
-	MAIN_URL      = "main:url"
-	MAIN_PATH     = "main:path"
-	SERVER_IP     = "server:ip"
-	SERVER_PORT   = "server:port"
-	SERVER_NAME   = "server:name"
-	LOG_DIR       = "log:dir"
-	LOG_FILE      = "log:file"
-	LOG_PERMS     = "log:perms"
-	LOG_LEVEL     = "log:level"
+	MAIN_DURATION      = "main:duration"
+	MAIN_URL           = "main:url"
+	MAIN_PATH          = "main:path"
+	MAIN_MARKER_POLICY = "main:marker-policy"
+	MAIN_STATE_DIR     = "main:state-dir"
+	MAIN_PID_DIR       = "main:pid-dir"
+	MAIN_LEVEL         = "main:level"
+	MAIN_PROFILE       = "main:profile"
+	MAIN_DRY_RUN       = "main:dry-run"
+	MAIN_INCLUDE       = "main:include"
+
+	SERVER_IP              = "server:ip"
+	SERVER_PORT            = "server:port"
+	SERVER_NAME            = "server:name"
+	SERVER_ALLOW           = "server:allow"
+	SERVER_TRUSTED_PROXIES = "server:trusted-proxies"
+	SERVER_PROXY_PROTOCOL  = "server:proxy-protocol"
+	SERVER_TRUST_LOOPBACK  = "server:trust-loopback"
+
+	TRIGGER_METHODS = "trigger:methods"
+	TRIGGER_CONFIRM = "trigger:confirm"
+
+	PROTECTION_RATE            = "protection:rate"
+	PROTECTION_MAX_FAILS       = "protection:max-fails"
+	PROTECTION_FAILS_WINDOW    = "protection:fails-window"
+	PROTECTION_BAN_TIME        = "protection:ban-time"
+	PROTECTION_LOCKDOWN        = "protection:lockdown"
+	PROTECTION_LOCKDOWN_BANS   = "protection:lockdown-bans"
+	PROTECTION_LOCKDOWN_WINDOW = "protection:lockdown-window"
+
+	WATCHDOG_INTERVAL = "watchdog:interval"
+
+	NOTIFY_URL = "notify:url"
+
+	AUTHLOG_ENABLED           = "authlog:enabled"
+	AUTHLOG_SOURCE            = "authlog:source"
+	AUTHLOG_ROOT_FAILS        = "authlog:root-fails"
+	AUTHLOG_ROOT_FAILS_WINDOW = "authlog:root-fails-window"
+	AUTHLOG_FAILS             = "authlog:fails"
+	AUTHLOG_FAILS_WINDOW      = "authlog:fails-window"
+	AUTHLOG_KNOWN_NETS        = "authlog:known-nets"
+
+	RESTRICTED_USERS      = "restricted:users"
+	RESTRICTED_NETS       = "restricted:nets"
+	RESTRICTED_KEYS       = "restricted:keys"
+	RESTRICTED_CONFIG_DIR = "restricted:config-dir"
+
+	HARDENING_NOLOGIN_MESSAGE = "hardening:nologin-message"
+	HARDENING_FIREWALL_ALLOW  = "hardening:firewall-allow"
+	HARDENING_LOCK_USERS      = "hardening:lock-users"
+
+	CANARY_PATHS = "canary:paths"
+
+	DEADMAN_ENABLED  = "deadman:enabled"
+	DEADMAN_KEY      = "deadman:key"
+	DEADMAN_TIMEOUT  = "deadman:timeout"
+	DEADMAN_MAX_SKEW = "deadman:max-skew"
+
+	DECOY_ENABLED = "decoy:enabled"
+	DECOY_PORT    = "decoy:port"
+	DECOY_BANNER  = "decoy:banner"
+
+	LOG_DIR    = "log:dir"
+	LOG_FILE   = "log:file"
+	LOG_PERMS  = "log:perms"
+	LOG_LEVEL  = "log:level"
+	LOG_FORMAT = "log:format"
+	LOG_AUDIT  = "log:audit"
+	LOG_EVENTS = "log:events"
+
 	SCRIPT_BEFORE = "script:before"
 	SCRIPT_IN     = "script:in"
 	SCRIPT_OUT    = "script:out"
-	SCRIPT_END    = "script:complete"
+	SCRIPT_END    = "script:end"
+	SCRIPT_DRIFT  = "script:drift"
 )
 
 // Options
 const (
 	OPT_CONFIG   = "c:config"
 	OPT_NO_COLOR = "nc:no-color"
+	OPT_JSON     = "j:json"
 	OPT_HELP     = "h:help"
 	OPT_VER      = "v:version"
 )
 
+// Commands
+const (
+	CMD_ROTATE         = "rotate"
+	CMD_RECOVERY_CODES = "recovery-codes"
+	CMD_RECOVER        = "recover"
+	CMD_PLAN           = "plan"
+	CMD_CHECK_CONFIG   = "check-config"
+)
+
 // Pid info
 const PID_FILE = "bastion.pid"
 
@@ -68,20 +143,18 @@ const PID_FILE = "bastion.pid"
 var optMap = options.Map{
 	OPT_CONFIG:   {Value: "/etc/bastion.knf"},
 	OPT_NO_COLOR: {Type: options.BOOL},
+	OPT_JSON:     {Type: options.BOOL},
 	OPT_HELP:     {Type: options.BOOL, Alias: "u:usage"},
 	OPT_VER:      {Type: options.BOOL, Alias: "ver"},
 }
 
-var key string
-var bastionPath string
-
 // ////////////////////////////////////////////////////////////////////////////////// //
 
 // Main function
 func Init() {
 	runtime.GOMAXPROCS(4)
 
-	_, errs := options.Parse(optMap)
+	args, errs := options.Parse(optMap)
 
 	if len(errs) != 0 {
 		for _, err := range errs {
@@ -105,27 +178,70 @@ func Init() {
 		return
 	}
 
+	// Configuration check reports all problems instead of exit on first one
+	if len(args) != 0 && string(args[0]) == CMD_CHECK_CONFIG {
+		checkConfig()
+		return
+	}
+
 	loadConfig()
 	validateConfig()
+	configureStateDir()
+
+	// Plan is read-only, so it must not create state directory and only
+	// reads marker if it exists
+	if len(args) != 0 && string(args[0]) == CMD_PLAN {
+		runCommand(args)
+		return
+	}
+
+	setupStateDir()
+
+	if len(args) != 0 {
+		runCommand(args)
+		return
+	}
+
 	registerSignalHandlers()
 	setupLogger()
 	createPidFile()
+	migrateState()
+	restoreSecrets()
+	setupNetwork()
+	startRequestGuard()
+	recoverState()
+
+	// State must be restored before start of triggers, otherwise they can
+	// enable bastion mode and overwrite marker
+	if isBastionMarkerExist() {
+		err := ctrl.Restore()
+
+		if err != nil {
+			log.Crit(err.Error())
+			shutdown(1)
+		}
+	}
 
-	if isBastionModeEnabled() {
-		restoreBastionMode()
-	} else {
-		startHTTPServer(
-			knf.GetS(SERVER_IP),
-			knf.GetS(SERVER_PORT),
-		)
+	setupTriggers()
+	startScheduler()
+	startDeadmanSwitch()
+
+	err := startHTTPServer(
+		knf.GetS(SERVER_IP),
+		knf.GetS(SERVER_PORT),
+	)
+
+	if err != nil {
+		log.Crit("Can't start HTTP server: %v", err)
+		ctrl.Shutdown(1)
 	}
 
-	shutdown(0)
+	ctrl.Shutdown(0)
 }
 
 // loadConfig read and parse configuration file
 func loadConfig() {
-	err := knf.Global(options.GetS(OPT_CONFIG))
+	err := loadGlobalConfig(options.GetS(OPT_CONFIG))
 
 	if err != nil {
 		printErrorAndExit(err.Error())
@@ -134,17 +250,97 @@ func loadConfig() {
 
 // validateConfig validate configuration file values
 func validateConfig() {
-	errs := knf.Validate([]*knf.Validator{
+	errs := knf.Validate(getConfigValidators(knf.Props))
+
+	if len(errs) != 0 {
+		printError("Error while configuration file validation:")
+
+		for _, err := range errs {
+			printError("  %v", err)
+		}
+
+		os.Exit(1)
+	}
+}
+
+// getConfigValidators returns validators for all configuration properties,
+// props returns list of properties in sections with user-defined properties
+func getConfigValidators(props func(section string) []string) []*knf.Validator {
+	validators := []*knf.Validator{
 		{SERVER_PORT, knfv.Empty, nil},
+		{SERVER_PORT, knfv.TypeNum, nil},
+		{SERVER_ALLOW, validateNetList, nil},
+		{SERVER_TRUSTED_PROXIES, validateNetList, nil},
+		{SERVER_PROXY_PROTOCOL, knfv.TypeBool, nil},
+		{SERVER_TRUST_LOOPBACK, knfv.TypeBool, nil},
 		{LOG_DIR, knfv.Empty, nil},
 		{LOG_FILE, knfv.Empty, nil},
 
 		{LOG_DIR, knff.Perms, "DW"},
 		{LOG_DIR, knff.Perms, "DX"},
 		{LOG_LEVEL, knfv.NotContains, []string{"debug", "info", "warn", "error", "crit"}},
+		{LOG_FORMAT, knfv.NotContains, []string{"", LOG_FORMAT_TEXT, LOG_FORMAT_JSON}},
 
+		{MAIN_DURATION, knfv.TypeNum, nil},
 		{MAIN_DURATION, knfv.Less, 3600},
-		{MAIN_DURATION, knfv.Greater, 604800},
+		{MAIN_DURATION, knfv.Greater, MAX_DURATION},
+		{MAIN_STATE_DIR, validateStateDir, nil},
+		{MAIN_PID_DIR, knff.Perms, "DW"},
+		{MAIN_MARKER_POLICY, knfv.NotContains, []string{"", POLICY_FAIL_CLOSED, POLICY_FAIL_OPEN}},
+		{MAIN_LEVEL, knfv.NotContains, []string{"", LEVEL_FULL, LEVEL_RESTRICTED}},
+		{MAIN_PROFILE, validateProfile, nil},
+		{MAIN_DRY_RUN, knfv.TypeBool, nil},
+
+		{RESTRICTED_USERS, validateRestrictedUsers, nil},
+		{RESTRICTED_NETS, validateNetList, nil},
+		{RESTRICTED_KEYS, knff.Perms, "FR"},
+		{RESTRICTED_CONFIG_DIR, knff.Perms, "DW"},
+
+		{TRIGGER_METHODS, validateMethods, nil},
+
+		{PROTECTION_RATE, knfv.TypeNum, nil},
+		{PROTECTION_RATE, knfv.Less, 0},
+		{PROTECTION_MAX_FAILS, knfv.TypeNum, nil},
+		{PROTECTION_MAX_FAILS, knfv.Less, 0},
+		{PROTECTION_FAILS_WINDOW, knfv.TypeNum, nil},
+		{PROTECTION_FAILS_WINDOW, knfv.Less, 0},
+		{PROTECTION_BAN_TIME, knfv.TypeNum, nil},
+		{PROTECTION_BAN_TIME, knfv.Less, 0},
+		{PROTECTION_LOCKDOWN, knfv.TypeBool, nil},
+		{PROTECTION_LOCKDOWN_BANS, knfv.TypeNum, nil},
+		{PROTECTION_LOCKDOWN_BANS, knfv.Less, 0},
+		{PROTECTION_LOCKDOWN_WINDOW, knfv.TypeNum, nil},
+		{PROTECTION_LOCKDOWN_WINDOW, knfv.Less, 0},
+
+		{WATCHDOG_INTERVAL, knfv.TypeNum, nil},
+		{WATCHDOG_INTERVAL, knfv.Less, 0},
+
+		{AUTHLOG_ENABLED, knfv.TypeBool, nil},
+		{AUTHLOG_ROOT_FAILS, knfv.TypeNum, nil},
+		{AUTHLOG_ROOT_FAILS, knfv.Less, 0},
+		{AUTHLOG_ROOT_FAILS_WINDOW, knfv.TypeNum, nil},
+		{AUTHLOG_ROOT_FAILS_WINDOW, knfv.Less, 0},
+		{AUTHLOG_FAILS, knfv.TypeNum, nil},
+		{AUTHLOG_FAILS, knfv.Less, 0},
+		{AUTHLOG_FAILS_WINDOW, knfv.TypeNum, nil},
+		{AUTHLOG_FAILS_WINDOW, knfv.Less, 0},
+		{AUTHLOG_KNOWN_NETS, validateNetList, nil},
+
+		{HARDENING_FIREWALL_ALLOW, validateNetList, nil},
+
+		{CANARY_PATHS, validateCanaryPaths, nil},
+
+		{DEADMAN_ENABLED, knfv.TypeBool, nil},
+		{DEADMAN_KEY, validateDeadmanKey, nil},
+		{DEADMAN_TIMEOUT, knfv.TypeNum, nil},
+		{DEADMAN_TIMEOUT, knfv.Less, 60},
+		{DEADMAN_MAX_SKEW, knfv.TypeNum, nil},
+		{DEADMAN_MAX_SKEW, knfv.Less, 0},
+
+		{DECOY_ENABLED, knfv.TypeBool, nil},
+		{DECOY_PORT, knfv.TypeNum, nil},
+		{DECOY_PORT, knfv.Less, 0},
+		{DECOY_PORT, knfv.Greater, 65535},
 
 		{SCRIPT_BEFORE, knff.Perms, "FS"},
 		{SCRIPT_BEFORE, knff.Perms, "FX"},
@@ -154,16 +350,269 @@ func validateConfig() {
 		{SCRIPT_OUT, knff.Perms, "FX"},
 		{SCRIPT_END, knff.Perms, "FS"},
 		{SCRIPT_END, knff.Perms, "FX"},
-	})
+		{SCRIPT_DRIFT, knff.Perms, "FS"},
+		{SCRIPT_DRIFT, knff.Perms, "FX"},
+	}
 
-	if len(errs) != 0 {
-		printError("Error while configuration file validation:")
+	validators = append(validators, getScheduleValidators(props)...)
+	validators = append(validators, getProfileValidators(props)...)
 
-		for _, err := range errs {
-			printError("  %v", err)
+	return validators
+}
+
+// validateMethods is knf validator for lists of HTTP methods
+func validateMethods(config *knf.Config, prop string, value interface{}) error {
+	for _, method := range strings.FieldsFunc(config.GetS(prop), isListSeparator) {
+		switch strings.ToUpper(method) {
+		case "GET", "POST", "PUT", "PATCH", "DELETE":
+			continue
 		}
 
-		os.Exit(1)
+		return fmt.Errorf("Property %s contains unsupported method \"%s\"", prop, method)
+	}
+
+	return nil
+}
+
+// configureStateDir configure paths to directories with state and PID files
+func configureStateDir() {
+	stateDir = knf.GetS(MAIN_STATE_DIR, DEFAULT_STATE_DIR)
+	pid.Dir = knf.GetS(MAIN_PID_DIR, "/var/run")
+}
+
+// setupStateDir create directory for state files
+func setupStateDir() {
+	err := createStateDir()
+
+	if err != nil {
+		printErrorAndExit(err.Error())
+	}
+}
+
+// runCommand run command passed as argument
+func runCommand(args options.Arguments) {
+	cmd := string(args[0])
+
+	switch cmd {
+	case CMD_ROTATE:
+		rotateSecrets()
+	case CMD_RECOVERY_CODES:
+		createRecoveryCodes()
+	case CMD_RECOVER:
+		if len(args) < 2 {
+			printErrorAndExit("You must define recovery code")
+		}
+
+		recoverBastion(string(args[1]))
+	case CMD_PLAN:
+		var profile string
+
+		if len(args) > 1 {
+			profile = string(args[1])
+		}
+
+		showPlan(profile)
+	default:
+		printErrorAndExit("Unknown command \"%s\"", cmd)
+	}
+}
+
+// rotateSecrets generate new bastion link and notify running daemon
+func rotateSecrets() {
+	_, link, err := generateSecrets()
+
+	if err != nil {
+		printErrorAndExit(err.Error())
+	}
+
+	err = removeBootstrapToken()
+
+	if err != nil {
+		printWarn(err.Error())
+	}
+
+	daemonPID := pid.Get(PID_FILE)
+
+	if daemonPID != -1 {
+		err = syscall.Kill(daemonPID, syscall.SIGHUP)
+
+		if err != nil {
+			printWarn("Can't send HUP signal to daemon: %v", err)
+		}
+	}
+
+	fmtc.Printf("Your new unique bastion link is: {c}%s{!}\n", link)
+}
+
+// createRecoveryCodes generate new set of recovery codes and print them
+func createRecoveryCodes() {
+	codes, err := generateRecoveryCodes()
+
+	if err != nil {
+		printErrorAndExit(err.Error())
+	}
+
+	fmtc.Println("Your recovery codes (store them offline, each code can be used only once):\n")
+
+	for _, code := range codes {
+		fmtc.Printf("  {c}%s{!}\n", code)
+	}
+
+	fmtc.Println("\n{y}All previously generated recovery codes are invalidated{!}")
+}
+
+// recoverBastion end bastion mode using recovery code
+func recoverBastion(code string) {
+	if pid.Get(PID_FILE) != -1 {
+		err := sendRecoveryRequest(code)
+
+		if err != nil {
+			printErrorAndExit(err.Error())
+		}
+
+		fmtc.Println("{g}Bastion mode disabled{!}")
+		return
+	}
+
+	if !isBastionMarkerExist() {
+		printErrorAndExit(ErrNotActive.Error())
+	}
+
+	if knf.GetS(LOG_AUDIT) != "" {
+		err := auditLog.Open(knf.GetS(LOG_AUDIT), 0600)
+
+		if err != nil {
+			printErrorAndExit("Can't open audit log: %v", err)
+		}
+	}
+
+	// Daemon is not running, so bastion mode is disabled by this process
+	num, err := checkRecoveryCode(code)
+
+	if err != nil {
+		logEvent(
+			EVENT_LEVEL_WARN,
+			&Event{Event: EVENT_RECOVERY_FAILED, Source: "console", Error: err.Error()},
+			"[SUSPICIOUS] Recovery attempt from console failed: %v", err,
+		)
+		printErrorAndExit(err.Error())
+	}
+
+	logEvent(
+		EVENT_LEVEL_WARN,
+		&Event{Event: EVENT_RECOVERY_USED, Source: "console"},
+		"[IMPORTANT] Recovery code #%d used from console, disabling bastion mode...", num,
+	)
+
+	err = disableBastionMode()
+
+	if err != nil {
+		printErrorAndExit(err.Error())
+	}
+
+	// Code is spent only if bastion mode is disabled, so it can be used again
+	// if disabling failed
+	err = spendRecoveryCode(code, "console")
+
+	if err != nil {
+		printErrorAndExit(err.Error())
+	}
+
+	fmtc.Println("{g}Bastion mode disabled{!}")
+}
+
+// showPlan print actions which bastion mode enabling and disabling would perform
+func showPlan(profile string) {
+	plan, err := buildPlan(profile)
+
+	if err != nil {
+		printErrorAndExit(err.Error())
+	}
+
+	printPlan(plan)
+}
+
+// migrateState move state files used by previous versions to state directory
+func migrateState() {
+	err := migrateLegacyState()
+
+	if err != nil {
+		log.Crit(err.Error())
+		shutdown(1)
+	}
+}
+
+// restoreSecrets read persisted secrets
+func restoreSecrets() {
+	secrets, err := readSecrets()
+
+	if err != nil {
+		log.Crit(err.Error())
+		shutdown(1)
+	}
+
+	if secrets != nil {
+		log.Info("Bastion link secrets restored from %s", getStatePath(SECRETS_FILE))
+
+		err = removeBootstrapToken()
+
+		if err != nil {
+			log.Error(err.Error())
+		}
+
+		ctrl.SetSecrets(secrets, "")
+
+		return
+	}
+
+	token, err := createBootstrapToken()
+
+	if err != nil {
+		log.Crit(err.Error())
+		shutdown(1)
+	}
+
+	ctrl.SetSecrets(nil, token)
+}
+
+// recoverState finish or roll back transaction interrupted by crash
+func recoverState() {
+	err := recoverTransaction()
+
+	switch {
+	case errors.Is(err, ErrTxNotFinished):
+		// Marker is kept, so bastion mode will be restored
+		log.Crit("[IMPORTANT] %v", err)
+	case err != nil:
+		log.Crit(err.Error())
+		shutdown(1)
+	}
+}
+
+// setupNetwork setup allowlist and trusted proxies
+func setupNetwork() {
+	err := configureNetwork()
+
+	if err != nil {
+		log.Crit(err.Error())
+		shutdown(1)
+	}
+}
+
+// setupTriggers start automatic bastion mode triggers
+func setupTriggers() {
+	err := startAuthLogWatcher()
+
+	if err != nil {
+		log.Crit(err.Error())
+		shutdown(1)
+	}
+
+	err = startCanaryWatcher()
+
+	if err != nil {
+		log.Crit(err.Error())
+		shutdown(1)
 	}
 }
 
@@ -173,6 +622,8 @@ func registerSignalHandlers() {
 		signal.TERM: termSignalHandler,
 		signal.INT:  intSignalHandler,
 		signal.HUP:  hupSignalHandler,
+		signal.USR1: usr1SignalHandler,
+		signal.USR2: usr2SignalHandler,
 	}.TrackAsync()
 }
 
@@ -189,6 +640,12 @@ func setupLogger() {
 	if err != nil {
 		printErrorAndExit(err.Error())
 	}
+
+	err = setupEventLogs()
+
+	if err != nil {
+		printErrorAndExit(err.Error())
+	}
 }
 
 // createPidFile create PID file
@@ -203,20 +660,56 @@ func createPidFile() {
 // INT signal handler
 func intSignalHandler() {
 	log.Aux("Received INT signal, shutdown...")
-	shutdown(0)
+	ctrl.Shutdown(0)
 }
 
 // TERM signal handler
 func termSignalHandler() {
 	log.Aux("Received TERM signal, shutdown...")
-	shutdown(0)
+	ctrl.Shutdown(0)
 }
 
 // HUP signal handler
 func hupSignalHandler() {
 	log.Info("Received HUP signal, log will be reopened...")
 	log.Reopen()
+	reopenEventLogs()
 	log.Info("Log reopened by HUP signal")
+
+	reloadConfig()
+
+	secrets, err := readSecrets()
+
+	if err != nil {
+		log.Error(err.Error())
+		return
+	}
+
+	if secrets != nil {
+		ctrl.SetSecrets(secrets, "")
+		log.Info("Secrets reloaded by HUP signal")
+	}
+}
+
+// USR1 signal handler
+func usr1SignalHandler() {
+	log.Warn("[IMPORTANT] Received USR1 signal, enabling bastion mode...")
+
+	err := ctrl.Activate(&Trigger{
+		Source: "signal",
+		Actor:  "USR1",
+		Reason: "Panic signal received",
+	})
+
+	if err != nil {
+		log.Info("USR1 signal ignored: %v", err)
+	}
+}
+
+// USR2 signal handler
+func usr2SignalHandler() {
+	log.Info("Received USR2 signal, dumping state...")
+	dumpStatus()
 }
 
 // printError prints error message to console
@@ -246,8 +739,15 @@ func shutdown(code int) {
 func showUsage() {
 	info := usage.NewInfo()
 
+	info.AddCommand(CMD_ROTATE, "Generate new unique bastion link")
+	info.AddCommand(CMD_RECOVERY_CODES, "Generate new set of single-use recovery codes")
+	info.AddCommand(CMD_RECOVER, "End bastion mode using recovery code", "code")
+	info.AddCommand(CMD_PLAN, "Show actions which bastion mode would perform", "?profile")
+	info.AddCommand(CMD_CHECK_CONFIG, "Check configuration file")
+
 	info.AddOption(OPT_CONFIG, "Path to config file", "file")
 	info.AddOption(OPT_NO_COLOR, "Disable colors in output")
+	info.AddOption(OPT_JSON, "Print configuration check results in JSON format")
 	info.AddOption(OPT_HELP, "Show this help message")
 	info.AddOption(OPT_VER, "Show version")
 
@@ -0,0 +1,261 @@
+package daemon
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+//                                                                                    //
+//                         Copyright (c) 2022 ESSENTIAL KAOS                          //
+//      Apache License, Version 2.0 <https://www.apache.org/licenses/LICENSE-2.0>     //
+//                                                                                    //
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/essentialkaos/ek/v12/fsutil"
+	"github.com/essentialkaos/ek/v12/jsonutil"
+	"github.com/essentialkaos/ek/v12/knf"
+	"github.com/essentialkaos/ek/v12/log"
+)
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// DEADMAN_CHECK_INTERVAL is interval between deadline checks
+const DEADMAN_CHECK_INTERVAL = 10 * time.Second
+
+// MIN_DEADMAN_KEY_LENGTH is minimal length of heartbeat signing key
+const MIN_DEADMAN_KEY_LENGTH = 16
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// Heartbeat contains info about last accepted check-in
+type Heartbeat struct {
+	Timestamp int64  `json:"timestamp"`
+	CheckIn   int64  `json:"check_in"`
+	Actor     string `json:"actor"`
+}
+
+// deadmanSwitch enables bastion mode if check-ins stop
+type deadmanSwitch struct {
+	last    *Heartbeat
+	started int64
+	mx      sync.Mutex
+}
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+var (
+	ErrHeartbeatDisabled  = errors.New("Dead-man switch is disabled")
+	ErrHeartbeatSignature = errors.New("Heartbeat signature is invalid")
+	ErrHeartbeatSkew      = errors.New("Heartbeat timestamp is too far from current time")
+	ErrHeartbeatReplay    = errors.New("Heartbeat timestamp is already used")
+)
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+var deadman = &deadmanSwitch{}
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// startDeadmanSwitch starts dead-man switch if it enabled
+func startDeadmanSwitch() {
+	if !knf.GetB(DEADMAN_ENABLED) {
+		return
+	}
+
+	deadman.mx.Lock()
+	deadman.started = time.Now().Unix()
+	deadman.last = readHeartbeat()
+	deadman.mx.Unlock()
+
+	log.Info(
+		"Dead-man switch started, next check-in required before %s",
+		formatTimestamp(deadman.Deadline()),
+	)
+
+	go deadman.watch()
+}
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// CheckIn verifies signed heartbeat and moves deadline
+func (d *deadmanSwitch) CheckIn(timestamp, signature, actor string) error {
+	if !knf.GetB(DEADMAN_ENABLED) {
+		return ErrHeartbeatDisabled
+	}
+
+	if !isValidHeartbeatSignature(timestamp, signature) {
+		return ErrHeartbeatSignature
+	}
+
+	ts, _ := strconv.ParseInt(timestamp, 10, 64)
+	now := time.Now().Unix()
+	skew := knf.GetI64(DEADMAN_MAX_SKEW, 300)
+
+	if ts < now-skew || ts > now+skew {
+		return ErrHeartbeatSkew
+	}
+
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	if d.last != nil && ts <= d.last.Timestamp {
+		return ErrHeartbeatReplay
+	}
+
+	d.last = &Heartbeat{Timestamp: ts, CheckIn: now, Actor: actor}
+
+	err := writeJSONAtomic(getStatePath(HEARTBEAT_FILE), d.last)
+
+	if err != nil {
+		log.Error("Can't save heartbeat: %v", err)
+	}
+
+	return nil
+}
+
+// Rearm gives client full timeout for check-in after bastion mode end
+func (d *deadmanSwitch) Rearm() {
+	d.mx.Lock()
+	d.started = time.Now().Unix()
+	d.mx.Unlock()
+}
+
+// Deadline returns time of deadline for next check-in
+func (d *deadmanSwitch) Deadline() int64 {
+	if !knf.GetB(DEADMAN_ENABLED) {
+		return 0
+	}
+
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	last := d.started
+
+	// Time before daemon start is not counted, so after restart client
+	// always has full timeout for check-in
+	if d.last != nil && d.last.CheckIn > last {
+		last = d.last.CheckIn
+	}
+
+	return last + knf.GetI64(DEADMAN_TIMEOUT, 3600)
+}
+
+// watch enables bastion mode if deadline is missed
+func (d *deadmanSwitch) watch() {
+	// Deadline for which plan was logged in dry-run mode
+	var dryRunDeadline int64
+
+	ticker := time.NewTicker(DEADMAN_CHECK_INTERVAL)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		deadline := d.Deadline()
+
+		if deadline == 0 || time.Now().Unix() < deadline {
+			continue
+		}
+
+		// In dry-run mode plan is logged only once for every missed deadline,
+		// switch fires again if dry-run mode is disabled by configuration reload
+		if deadline == dryRunDeadline && knf.GetB(MAIN_DRY_RUN) {
+			continue
+		}
+
+		state := ctrl.State()
+
+		if state != STATE_IDLE && state != STATE_ARMED {
+			continue
+		}
+
+		actor := "unknown"
+
+		d.mx.Lock()
+		if d.last != nil {
+			actor = d.last.Actor
+		}
+		d.mx.Unlock()
+
+		log.Warn("[IMPORTANT] Check-in deadline missed, enabling bastion mode...")
+
+		err := ctrl.Activate(&Trigger{
+			Source: "deadman",
+			Actor:  actor,
+			Reason: fmt.Sprintf("No check-in before %s", formatTimestamp(deadline)),
+		})
+
+		if err == ErrDryRun {
+			dryRunDeadline = deadline
+			continue
+		}
+
+		if err != nil {
+			log.Error("Can't enable bastion mode by dead-man switch: %v", err)
+		}
+	}
+}
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// readHeartbeat reads info about last accepted heartbeat
+func readHeartbeat() *Heartbeat {
+	if !fsutil.IsExist(getStatePath(HEARTBEAT_FILE)) {
+		return nil
+	}
+
+	heartbeat := &Heartbeat{}
+	err := jsonutil.Read(getStatePath(HEARTBEAT_FILE), heartbeat)
+
+	if err != nil {
+		log.Error("Can't read heartbeat: %v", err)
+		return nil
+	}
+
+	return heartbeat
+}
+
+// isValidHeartbeatSignature returns true if signature is valid HMAC-SHA256
+// of timestamp
+func isValidHeartbeatSignature(timestamp, signature string) bool {
+	if timestamp == "" || signature == "" {
+		return false
+	}
+
+	_, err := strconv.ParseInt(timestamp, 10, 64)
+
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, []byte(knf.GetS(DEADMAN_KEY)))
+	mac.Write([]byte(timestamp))
+
+	return hmac.Equal(
+		[]byte(hex.EncodeToString(mac.Sum(nil))),
+		[]byte(strings.ToLower(signature)),
+	)
+}
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// validateDeadmanKey is knf validator for heartbeat signing key
+func validateDeadmanKey(config *knf.Config, prop string, value interface{}) error {
+	if !config.GetB(DEADMAN_ENABLED) {
+		return nil
+	}
+
+	if len(config.GetS(prop)) < MIN_DEADMAN_KEY_LENGTH {
+		return fmt.Errorf(
+			"Property %s must be at least %d symbols long if dead-man switch is enabled",
+			prop, MIN_DEADMAN_KEY_LENGTH,
+		)
+	}
+
+	return nil
+}
@@ -0,0 +1,91 @@
+package daemon
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+//                                                                                    //
+//                         Copyright (c) 2022 ESSENTIAL KAOS                          //
+//      Apache License, Version 2.0 <https://www.apache.org/licenses/LICENSE-2.0>     //
+//                                                                                    //
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// TEST_DEADMAN_KEY is key used for signing heartbeats in tests
+const TEST_DEADMAN_KEY = "0123456789abcdef0123456789abcdef"
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+func TestIsValidHeartbeatSignature(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "bastion.knf")
+	err := os.WriteFile(file, []byte("[deadman]\n  enabled: true\n  key: "+TEST_DEADMAN_KEY+"\n"), 0600)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv(getConfigEnvName(MAIN_INCLUDE), "")
+
+	err = loadGlobalConfig(file)
+
+	if err != nil {
+		t.Fatalf("Can't load configuration: %v", err)
+	}
+
+	valid := signHeartbeat(TEST_DEADMAN_KEY, "1760000000")
+
+	tests := []struct {
+		name      string
+		timestamp string
+		signature string
+		isValid   bool
+	}{
+		{"valid", "1760000000", valid, true},
+		{"uppercase signature", "1760000000", strings.ToUpper(valid), true},
+		{"other timestamp", "1760000001", valid, false},
+		{"other key", "1760000000", signHeartbeat("fedcba9876543210fedcba9876543210", "1760000000"), false},
+		{"truncated signature", "1760000000", valid[:32], false},
+		{"raw signature", "1760000000", string(mustDecodeHex(t, valid)), false},
+		{"empty signature", "1760000000", "", false},
+		{"empty timestamp", "", signHeartbeat(TEST_DEADMAN_KEY, ""), false},
+		{"non-numeric timestamp", "now", signHeartbeat(TEST_DEADMAN_KEY, "now"), false},
+		{"timestamp with spaces", " 1760000000", signHeartbeat(TEST_DEADMAN_KEY, " 1760000000"), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if isValidHeartbeatSignature(tt.timestamp, tt.signature) != tt.isValid {
+				t.Fatalf("Signature validity must be %t", tt.isValid)
+			}
+		})
+	}
+}
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// signHeartbeat returns HMAC-SHA256 signature of timestamp in hex
+func signHeartbeat(key, timestamp string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(timestamp))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// mustDecodeHex decodes hex string
+func mustDecodeHex(t *testing.T, data string) []byte {
+	result, err := hex.DecodeString(data)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return result
+}
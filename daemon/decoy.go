@@ -0,0 +1,349 @@
+package daemon
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+//                                                                                    //
+//                         Copyright (c) 2022 ESSENTIAL KAOS                          //
+//      Apache License, Version 2.0 <https://www.apache.org/licenses/LICENSE-2.0>     //
+//                                                                                    //
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/essentialkaos/ek/v12/fsutil"
+	"github.com/essentialkaos/ek/v12/knf"
+	"github.com/essentialkaos/ek/v12/log"
+)
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// DECOY_TIMEOUT is timeout for reading client version from connection
+const DECOY_TIMEOUT = 10 * time.Second
+
+// MAX_VERSION_LENGTH is maximum length of client version string
+const MAX_VERSION_LENGTH = 255
+
+// MAX_TOP_SIZE is maximum number of IPs in attempts summary
+const MAX_TOP_SIZE = 10
+
+// MAX_DECOY_CONNS is maximum number of concurrent connections to decoy
+const MAX_DECOY_CONNS = 64
+
+// MAX_RECORDED_ATTEMPTS is maximum number of attempts per minute written to
+// log and attempts log, other attempts are only counted
+const MAX_RECORDED_ATTEMPTS = 60
+
+// MAX_ATTEMPTS_LOG_SIZE is maximum size of attempts log in bytes, bigger log
+// is rotated
+const MAX_ATTEMPTS_LOG_SIZE = 10 * 1024 * 1024
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// Attempt contains info about connection attempt
+type Attempt struct {
+	Time    int64  `json:"time"`
+	IP      string `json:"ip"`
+	Port    int    `json:"port"`
+	Version string `json:"version"`
+}
+
+// AttemptsSummary contains summary info about connection attempts
+type AttemptsSummary struct {
+	Total     int              `json:"total"`
+	UniqueIPs int              `json:"unique_ips"`
+	Top       []*AttemptsCount `json:"top"`
+	Last      *Attempt         `json:"last,omitempty"`
+}
+
+// AttemptsCount contains number of attempts from IP
+type AttemptsCount struct {
+	IP    string `json:"ip"`
+	Count int    `json:"count"`
+}
+
+// decoy is decoy SSH listener
+type decoy struct {
+	listener    net.Listener
+	total       int
+	ips         map[string]int
+	last        *Attempt
+	windowStart int64 // Start of current minute of recording
+	recorded    int   // Number of attempts recorded in current minute
+	mx          sync.Mutex
+}
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+var sshDecoy = &decoy{}
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// Start starts decoy listener if it enabled and sshd is stopped
+func (d *decoy) Start(marker *BastionMarker) {
+	// With some profiles sshd still works on SSH port
+	if !knf.GetB(DECOY_ENABLED) || marker == nil || marker.GetAction(ACTION_STOP_SSHD) == nil {
+		return
+	}
+
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	if d.listener != nil {
+		return
+	}
+
+	d.loadAttempts()
+
+	addr := ":" + knf.GetS(DECOY_PORT, "22")
+	ln, err := net.Listen("tcp", addr)
+
+	if err != nil {
+		log.Error("Can't start decoy SSH listener on %s: %v", addr, err)
+		return
+	}
+
+	d.listener = ln
+
+	log.Info("Decoy SSH listener started on %s", addr)
+
+	go d.serve(ln)
+}
+
+// Stop stops decoy listener
+func (d *decoy) Stop() {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	if d.listener == nil {
+		return
+	}
+
+	d.listener.Close()
+	d.listener = nil
+
+	log.Info("Decoy SSH listener stopped")
+}
+
+// Summary returns summary info about connection attempts
+func (d *decoy) Summary() *AttemptsSummary {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	summary := &AttemptsSummary{
+		Total:     d.total,
+		UniqueIPs: len(d.ips),
+		Last:      d.last,
+	}
+
+	for ip, count := range d.ips {
+		summary.Top = append(summary.Top, &AttemptsCount{ip, count})
+	}
+
+	sort.Slice(summary.Top, func(i, j int) bool {
+		if summary.Top[i].Count == summary.Top[j].Count {
+			return summary.Top[i].IP < summary.Top[j].IP
+		}
+
+		return summary.Top[i].Count > summary.Top[j].Count
+	})
+
+	if len(summary.Top) > MAX_TOP_SIZE {
+		summary.Top = summary.Top[:MAX_TOP_SIZE]
+	}
+
+	return summary
+}
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// serve accepts connections
+func (d *decoy) serve(ln net.Listener) {
+	conns := make(chan struct{}, MAX_DECOY_CONNS)
+
+	for {
+		conn, err := ln.Accept()
+
+		if err != nil {
+			return
+		}
+
+		select {
+		case conns <- struct{}{}:
+			go func() {
+				d.processConn(conn)
+				<-conns
+			}()
+		default:
+			// Too many concurrent connections, attempt is counted anyway
+			conn.Close()
+			d.record(newAttempt(conn))
+		}
+	}
+}
+
+// processConn sends banner, reads client version and records attempt
+func (d *decoy) processConn(conn net.Conn) {
+	defer conn.Close()
+
+	attempt := newAttempt(conn)
+
+	conn.SetDeadline(time.Now().Add(DECOY_TIMEOUT))
+
+	_, err := conn.Write([]byte(knf.GetS(DECOY_BANNER, "SSH-2.0-OpenSSH_7.4") + "\r\n"))
+
+	if err == nil {
+		reader := bufio.NewReaderSize(conn, MAX_VERSION_LENGTH+1)
+		line, _ := reader.ReadSlice('\n')
+
+		if len(line) > MAX_VERSION_LENGTH {
+			line = line[:MAX_VERSION_LENGTH]
+		}
+
+		attempt.Version = strings.TrimSpace(strings.ToValidUTF8(string(line), "?"))
+	}
+
+	d.record(attempt)
+}
+
+// record adds attempt to stats and attempts log, number of recorded attempts
+// is limited, so flood can't fill disk with state files
+func (d *decoy) record(attempt *Attempt) {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	d.addToStats(attempt)
+
+	if attempt.Time-d.windowStart >= 60 {
+		d.windowStart, d.recorded = attempt.Time, 0
+	}
+
+	d.recorded++
+
+	switch {
+	case d.recorded > MAX_RECORDED_ATTEMPTS:
+		return
+	case d.recorded == MAX_RECORDED_ATTEMPTS:
+		log.Warn("[SUSPICIOUS] Too many connection attempts to SSH port, recording paused for a minute")
+	}
+
+	log.Warn(
+		"[SUSPICIOUS] Connection attempt to SSH port from %s:%d (client: %s)",
+		attempt.IP, attempt.Port, attempt.Version,
+	)
+
+	err := appendAttempt(attempt)
+
+	if err != nil {
+		log.Error(err.Error())
+	}
+}
+
+// addToStats adds attempt to stats
+func (d *decoy) addToStats(attempt *Attempt) {
+	if d.ips == nil {
+		d.ips = make(map[string]int)
+	}
+
+	d.total++
+	d.ips[attempt.IP]++
+	d.last = attempt
+}
+
+// loadAttempts reads attempts from rotated and current attempts logs
+func (d *decoy) loadAttempts() {
+	d.total, d.ips, d.last = 0, nil, nil
+
+	for _, file := range []string{getRotatedAttemptsLog(), getStatePath(ATTEMPTS_FILE)} {
+		d.loadAttemptsLog(file)
+	}
+}
+
+// loadAttemptsLog reads attempts from given attempts log
+func (d *decoy) loadAttemptsLog(file string) {
+	fd, err := os.Open(file)
+
+	if err != nil {
+		return
+	}
+
+	defer fd.Close()
+
+	scanner := bufio.NewScanner(fd)
+
+	for scanner.Scan() {
+		attempt := &Attempt{}
+
+		if json.Unmarshal(scanner.Bytes(), attempt) == nil {
+			d.addToStats(attempt)
+		}
+	}
+}
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// newAttempt creates attempt for given connection
+func newAttempt(conn net.Conn) *Attempt {
+	attempt := &Attempt{Time: time.Now().Unix()}
+
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		attempt.IP, attempt.Port = addr.IP.String(), addr.Port
+	}
+
+	return attempt
+}
+
+// appendAttempt appends info about attempt to attempts log
+func appendAttempt(attempt *Attempt) error {
+	data, err := json.Marshal(attempt)
+
+	if err != nil {
+		return err
+	}
+
+	err = rotateAttemptsLog()
+
+	if err != nil {
+		return fmt.Errorf("Can't rotate attempts log: %v", err)
+	}
+
+	fd, err := os.OpenFile(getStatePath(ATTEMPTS_FILE), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+
+	if err != nil {
+		return fmt.Errorf("Can't open attempts log: %v", err)
+	}
+
+	defer fd.Close()
+
+	_, err = fd.Write(append(data, '\n'))
+
+	if err != nil {
+		return fmt.Errorf("Can't write attempt to log: %v", err)
+	}
+
+	return nil
+}
+
+// rotateAttemptsLog moves attempts log to rotated log if its size exceeds
+// the limit, previous rotated log is removed
+func rotateAttemptsLog() error {
+	file := getStatePath(ATTEMPTS_FILE)
+
+	if fsutil.GetSize(file) < MAX_ATTEMPTS_LOG_SIZE {
+		return nil
+	}
+
+	return os.Rename(file, getRotatedAttemptsLog())
+}
+
+// getRotatedAttemptsLog returns path to rotated attempts log
+func getRotatedAttemptsLog() string {
+	return getStatePath(ATTEMPTS_FILE) + ".1"
+}
@@ -0,0 +1,252 @@
+package daemon
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+//                                                                                    //
+//                         Copyright (c) 2022 ESSENTIAL KAOS                          //
+//      Apache License, Version 2.0 <https://www.apache.org/licenses/LICENSE-2.0>     //
+//                                                                                    //
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/essentialkaos/ek/v12/knf"
+	"github.com/essentialkaos/ek/v12/log"
+)
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// Log formats
+const (
+	LOG_FORMAT_TEXT = "text"
+	LOG_FORMAT_JSON = "json"
+)
+
+// Events names, they are part of public interface and must not be changed
+const (
+	EVENT_TRIGGER_ACCEPTED   = "trigger.accepted"
+	EVENT_TRIGGER_REJECTED   = "trigger.rejected"
+	EVENT_MODE_ENTER         = "mode.enter"
+	EVENT_MODE_RESTORE       = "mode.restore"
+	EVENT_MODE_ESCALATE      = "mode.escalate"
+	EVENT_MODE_EXIT          = "mode.exit"
+	EVENT_ACTION_APPLIED     = "action.applied"
+	EVENT_ACTION_REAPPLIED   = "action.reapplied"
+	EVENT_ACTION_DRIFT       = "action.drift"
+	EVENT_ACTION_REVERTED    = "action.reverted"
+	EVENT_ACTION_FAILED      = "action.failed"
+	EVENT_RECOVERY_USED      = "recovery.used"
+	EVENT_RECOVERY_FAILED    = "recovery.failed"
+	EVENT_CONFIG_RELOADED    = "config.reloaded"
+	EVENT_CLIENT_BANNED      = "client.banned"
+	EVENT_BOOTSTRAP_ISSUED   = "bootstrap.issued"
+	EVENT_BOOTSTRAP_REJECTED = "bootstrap.rejected"
+)
+
+// EVENT_AUDIT_FAILED is name of event sent if event can't be written to
+// audit log
+const EVENT_AUDIT_FAILED = "audit-failed"
+
+// Events levels
+const (
+	EVENT_LEVEL_INFO  = "info"
+	EVENT_LEVEL_WARN  = "warn"
+	EVENT_LEVEL_ERROR = "error"
+	EVENT_LEVEL_CRIT  = "crit"
+)
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// Event is security-relevant event
+type Event struct {
+	Time     string `json:"time"`
+	Level    string `json:"level"`
+	Event    string `json:"event"`
+	Message  string `json:"message"`
+	Source   string `json:"source,omitempty"`
+	Actor    string `json:"actor,omitempty"`
+	SourceIP string `json:"source_ip,omitempty"`
+	Action   string `json:"action,omitempty"`
+	Profile  string `json:"profile,omitempty"`
+	Duration int64  `json:"duration,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// eventWriter writes events in JSON format to file
+type eventWriter struct {
+	file  string
+	perms os.FileMode
+	fd    *os.File
+	mx    sync.Mutex
+}
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+var (
+	// eventLog is writer of events to events log in JSON log format
+	eventLog = &eventWriter{}
+
+	// auditLog is writer of events to append-only audit log
+	auditLog = &eventWriter{}
+)
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// setupEventLogs opens events log in JSON format and audit log, main log
+// always contains only text records
+func setupEventLogs() error {
+	if knf.GetS(LOG_FORMAT, LOG_FORMAT_TEXT) == LOG_FORMAT_JSON {
+		file := knf.GetS(LOG_EVENTS, filepath.Join(knf.GetS(LOG_DIR), "events.log"))
+		err := eventLog.Open(file, knf.GetM(LOG_PERMS, 644))
+
+		if err != nil {
+			return fmt.Errorf("Can't open log for events: %v", err)
+		}
+	}
+
+	if knf.GetS(LOG_AUDIT) != "" {
+		err := auditLog.Open(knf.GetS(LOG_AUDIT), 0600)
+
+		if err != nil {
+			return fmt.Errorf("Can't open audit log: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// reopenEventLogs reopens event logs after rotation
+func reopenEventLogs() {
+	for _, w := range []*eventWriter{eventLog, auditLog} {
+		err := w.Reopen()
+
+		if err != nil {
+			log.Error("Can't reopen %s: %v", w.file, err)
+		}
+	}
+}
+
+// logEvent writes event to log, events log and audit log, audit log is flushed
+// to disk before returning, so no event is lost on crash or power failure
+func logEvent(level string, event *Event, f string, a ...interface{}) {
+	event.Time = time.Now().UTC().Format(time.RFC3339)
+	event.Level = level
+	event.Message = fmt.Sprintf(f, a...)
+
+	if event.SourceIP == "" && net.ParseIP(event.Actor) != nil {
+		event.SourceIP = event.Actor
+	}
+
+	writeTextEvent(event)
+
+	err := eventLog.Write(event)
+
+	if err != nil {
+		log.Error("Can't write event to events log: %v", err)
+	}
+
+	err = auditLog.Write(event)
+
+	if err == nil {
+		err = auditLog.Sync()
+	}
+
+	if err != nil {
+		log.Crit("[IMPORTANT] Can't write event %s to audit log: %v", event.Event, err)
+		sendNotification(
+			EVENT_AUDIT_FAILED, "Can't write event to audit log",
+			map[string]string{"event": event.Event, "error": err.Error()},
+		)
+	}
+}
+
+// writeTextEvent writes event message to log
+func writeTextEvent(event *Event) {
+	switch event.Level {
+	case EVENT_LEVEL_WARN:
+		log.Warn(event.Message)
+	case EVENT_LEVEL_ERROR:
+		log.Error(event.Message)
+	case EVENT_LEVEL_CRIT:
+		log.Crit(event.Message)
+	default:
+		log.Info(event.Message)
+	}
+}
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// Open opens file for appending events
+func (w *eventWriter) Open(file string, perms os.FileMode) error {
+	w.mx.Lock()
+	defer w.mx.Unlock()
+
+	fd, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_APPEND, perms)
+
+	if err != nil {
+		return err
+	}
+
+	if w.fd != nil {
+		w.fd.Close()
+	}
+
+	w.file, w.perms, w.fd = file, perms, fd
+
+	return nil
+}
+
+// Reopen reopens file
+func (w *eventWriter) Reopen() error {
+	if !w.IsOpen() {
+		return nil
+	}
+
+	return w.Open(w.file, w.perms)
+}
+
+// IsOpen returns true if file is opened
+func (w *eventWriter) IsOpen() bool {
+	w.mx.Lock()
+	defer w.mx.Unlock()
+
+	return w.fd != nil
+}
+
+// Write writes event as a single JSON line
+func (w *eventWriter) Write(event *Event) error {
+	w.mx.Lock()
+	defer w.mx.Unlock()
+
+	if w.fd == nil {
+		return nil
+	}
+
+	data, err := json.Marshal(event)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = w.fd.Write(append(data, '\n'))
+
+	return err
+}
+
+// Sync flushes written events to disk
+func (w *eventWriter) Sync() error {
+	w.mx.Lock()
+	defer w.mx.Unlock()
+
+	if w.fd == nil {
+		return nil
+	}
+
+	return w.fd.Sync()
+}
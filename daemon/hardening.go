@@ -0,0 +1,465 @@
+package daemon
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+//                                                                                    //
+//                         Copyright (c) 2022 ESSENTIAL KAOS                          //
+//      Apache License, Version 2.0 <https://www.apache.org/licenses/LICENSE-2.0>     //
+//                                                                                    //
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/essentialkaos/ek/v12/fsutil"
+	"github.com/essentialkaos/ek/v12/knf"
+	"github.com/essentialkaos/ek/v12/log"
+)
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// NOLOGIN_FILE is path to file which disables login for non-root users
+const NOLOGIN_FILE = "/etc/nologin"
+
+// FIREWALL_CHAIN is name of iptables chain with bastion rules
+const FIREWALL_CHAIN = "BASTION"
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// sshdProcesses is list of names of sshd processes
+var sshdProcesses = []string{"sshd", "sshd-session"}
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// newNologinAction creates action which disables login for non-root users
+func newNologinAction() *Action {
+	return &Action{
+		Name: ACTION_NOLOGIN,
+		Apply: func() error {
+			log.Info("Disabling login for non-root users...")
+
+			msg := knf.GetS(HARDENING_NOLOGIN_MESSAGE, "System is in bastion mode, login is disabled")
+			err := writeFileAtomic(NOLOGIN_FILE, []byte(msg+"\n"), 0644)
+
+			if err != nil {
+				return fmt.Errorf("Can't create %s: %v", NOLOGIN_FILE, err)
+			}
+
+			return nil
+		},
+		Revert: func() error {
+			log.Info("Enabling login for non-root users...")
+
+			err := os.Remove(NOLOGIN_FILE)
+
+			if err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("Can't remove %s: %v", NOLOGIN_FILE, err)
+			}
+
+			return nil
+		},
+		Check: func() (bool, error) {
+			return fsutil.IsExist(NOLOGIN_FILE), nil
+		},
+	}
+}
+
+// newFirewallAction creates action which blocks all incoming connections except
+// allowed networks and bastion HTTP server
+func newFirewallAction() *Action {
+	return &Action{
+		Name:   ACTION_FIREWALL,
+		Apply:  applyFirewall,
+		Revert: revertFirewall,
+		Check:  isFirewallApplied,
+	}
+}
+
+// newKillSessionsAction creates action which terminates all SSH sessions
+func newKillSessionsAction() *Action {
+	return &Action{
+		Name: ACTION_KILL_SESSIONS,
+		Apply: func() error {
+			log.Info("Terminating SSH sessions...")
+
+			// sshd listener is not terminated, so profiles without stop-sshd
+			// action still allow new connections
+			for _, pid := range getSSHSessions() {
+				err := syscall.Kill(pid, syscall.SIGKILL)
+
+				if err != nil && err != syscall.ESRCH {
+					return fmt.Errorf("Can't terminate SSH session process %d: %v", pid, err)
+				}
+			}
+
+			log.Info("SSH sessions terminated")
+
+			return nil
+		},
+		Revert: func() error {
+			return nil
+		},
+		// New sessions (e.g. from allowlisted networks) are not a drift, so
+		// sessions are terminated only once while enabling bastion mode
+		Check: func() (bool, error) {
+			return false, nil
+		},
+		OneShot: true,
+	}
+}
+
+// newLockAccountsAction creates action which locks configured accounts
+func newLockAccountsAction() *Action {
+	return &Action{
+		Name: ACTION_LOCK_ACCOUNTS,
+		Apply: func() error {
+			for _, user := range getLockUsers() {
+				err := saveAccountState(user)
+
+				if err != nil {
+					return err
+				}
+
+				log.Info("Locking account %s...", user)
+
+				output, err := exec.Command("usermod", "-L", "-e", "1", user).CombinedOutput()
+
+				if err != nil {
+					return fmt.Errorf("Can't lock account %s: %s", user, strings.TrimSpace(string(output)))
+				}
+			}
+
+			return nil
+		},
+		Revert: func() error {
+			// Marker can be invalid, in this case all accounts are unlocked
+			marker, _ := getBastionMarkerInfo()
+
+			for _, user := range getRevertLockUsers(marker) {
+				err := restoreAccountState(user, marker)
+
+				if err != nil {
+					return err
+				}
+			}
+
+			return nil
+		},
+		Check: func() (bool, error) {
+			for _, user := range getLockUsers() {
+				locked, err := isAccountLocked(user)
+
+				if err != nil || !locked {
+					return false, err
+				}
+			}
+
+			return true, nil
+		},
+	}
+}
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// applyFirewall creates chain with bastion rules and adds it to INPUT chain
+func applyFirewall() error {
+	log.Info("Blocking incoming connections...")
+
+	// Remove leftovers of previous runs
+	revertFirewall()
+
+	allowed, err := parseNetList(knf.GetS(HARDENING_FIREWALL_ALLOW))
+
+	if err != nil {
+		return err
+	}
+
+	for _, bin := range getFirewallBinaries() {
+		rules := [][]string{
+			{"-N", FIREWALL_CHAIN},
+			{"-A", FIREWALL_CHAIN, "-i", "lo", "-j", "ACCEPT"},
+			{"-A", FIREWALL_CHAIN, "-m", "conntrack", "--ctstate", "ESTABLISHED,RELATED", "-j", "ACCEPT"},
+		}
+
+		for _, n := range filterNets(allowed, bin == "ip6tables") {
+			rules = append(rules, []string{"-A", FIREWALL_CHAIN, "-s", n.String(), "-j", "ACCEPT"})
+		}
+
+		port := knf.GetS(SERVER_PORT)
+		httpNets := filterNets(getAllowedNets(), bin == "ip6tables")
+
+		if len(getAllowedNets()) == 0 {
+			rules = append(rules, []string{"-A", FIREWALL_CHAIN, "-p", "tcp", "--dport", port, "-j", "ACCEPT"})
+		}
+
+		for _, n := range httpNets {
+			rules = append(rules, []string{
+				"-A", FIREWALL_CHAIN, "-p", "tcp", "-s", n.String(), "--dport", port, "-j", "ACCEPT",
+			})
+		}
+
+		rules = append(rules,
+			[]string{"-A", FIREWALL_CHAIN, "-j", "DROP"},
+			[]string{"-I", "INPUT", "1", "-j", FIREWALL_CHAIN},
+		)
+
+		for _, rule := range rules {
+			output, err := exec.Command(bin, rule...).CombinedOutput()
+
+			if err != nil {
+				return fmt.Errorf("%s %s failed: %s", bin, strings.Join(rule, " "), strings.TrimSpace(string(output)))
+			}
+		}
+	}
+
+	log.Info("Incoming connections blocked")
+
+	return nil
+}
+
+// revertFirewall removes chain with bastion rules
+func revertFirewall() error {
+	for _, bin := range getFirewallBinaries() {
+		for exec.Command(bin, "-D", "INPUT", "-j", FIREWALL_CHAIN).Run() == nil {
+			continue
+		}
+
+		exec.Command(bin, "-F", FIREWALL_CHAIN).Run()
+		exec.Command(bin, "-X", FIREWALL_CHAIN).Run()
+
+		if exec.Command(bin, "-n", "-L", FIREWALL_CHAIN).Run() == nil {
+			return fmt.Errorf("Can't remove %s chain with %s", FIREWALL_CHAIN, bin)
+		}
+	}
+
+	return nil
+}
+
+// isFirewallApplied returns true if chain with bastion rules is used
+func isFirewallApplied() (bool, error) {
+	for _, bin := range getFirewallBinaries() {
+		if exec.Command(bin, "-C", "INPUT", "-j", FIREWALL_CHAIN).Run() != nil {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// getFirewallBinaries returns list of available firewall binaries
+func getFirewallBinaries() []string {
+	result := []string{"iptables"}
+
+	_, err := exec.LookPath("ip6tables")
+
+	if err == nil {
+		result = append(result, "ip6tables")
+	}
+
+	return result
+}
+
+// filterNets returns only IPv4 or only IPv6 networks from list
+func filterNets(nets []*net.IPNet, ipv6 bool) []*net.IPNet {
+	var result []*net.IPNet
+
+	for _, n := range nets {
+		if (n.IP.To4() == nil) == ipv6 {
+			result = append(result, n)
+		}
+	}
+
+	return result
+}
+
+// getLockUsers returns list of accounts which must be locked
+func getLockUsers() []string {
+	return strings.FieldsFunc(knf.GetS(HARDENING_LOCK_USERS), isListSeparator)
+}
+
+// getRevertLockUsers returns list of accounts locked by bastion mode
+func getRevertLockUsers(marker *BastionMarker) []string {
+	var result []string
+
+	if marker != nil {
+		for _, account := range marker.Accounts {
+			result = append(result, account.User)
+		}
+	}
+
+	return appendUnique(result, getLockUsers()...)
+}
+
+// saveAccountState saves state of account before locking to marker, state
+// is saved only once, so re-applying doesn't overwrite it
+func saveAccountState(user string) error {
+	marker, err := getBastionMarkerInfo()
+
+	if err != nil {
+		return err
+	}
+
+	if marker.GetAccount(user) != nil {
+		return nil
+	}
+
+	state, err := getAccountState(user)
+
+	if err != nil {
+		return err
+	}
+
+	marker.Accounts = append(marker.Accounts, state)
+
+	return saveBastionMarker(marker)
+}
+
+// restoreAccountState restores lock and expiration date of account saved
+// in marker
+func restoreAccountState(user string, marker *BastionMarker) error {
+	var state *AccountState
+
+	if marker != nil {
+		state = marker.GetAccount(user)
+	}
+
+	if state == nil {
+		log.Warn("State of account %s before bastion mode is unknown, account will be unlocked", user)
+		state = &AccountState{User: user}
+	}
+
+	args := []string{"-e", state.Expire, user}
+
+	if state.Locked {
+		log.Info("Account %s was locked before bastion mode, restoring expiration date...", user)
+	} else {
+		log.Info("Unlocking account %s...", user)
+		args = append([]string{"-U"}, args...)
+	}
+
+	output, err := exec.Command("usermod", args...).CombinedOutput()
+
+	if err != nil {
+		return fmt.Errorf("Can't restore state of account %s: %s", user, strings.TrimSpace(string(output)))
+	}
+
+	return nil
+}
+
+// getAccountState returns current lock and expiration date of account
+func getAccountState(user string) (*AccountState, error) {
+	output, err := exec.Command("getent", "shadow", user).Output()
+
+	if err != nil {
+		return nil, fmt.Errorf("Can't get shadow record of account %s: %v", user, err)
+	}
+
+	fields := strings.Split(strings.TrimSpace(string(output)), ":")
+
+	if len(fields) < 8 {
+		return nil, fmt.Errorf("Can't parse shadow record of account %s", user)
+	}
+
+	return &AccountState{
+		User:   user,
+		Locked: strings.HasPrefix(fields[1], "!"),
+		Expire: fields[7],
+	}, nil
+}
+
+// getSSHSessions returns PIDs of sshd processes which serve connections,
+// such processes are children of sshd listener
+func getSSHSessions() []int {
+	var result []int
+
+	dirs, err := os.ReadDir("/proc")
+
+	if err != nil {
+		return nil
+	}
+
+	for _, dir := range dirs {
+		pid, err := strconv.Atoi(dir.Name())
+
+		if err != nil || !isSSHDProcess(pid) {
+			continue
+		}
+
+		if isSSHDProcess(getParentPID(pid)) {
+			result = append(result, pid)
+		}
+	}
+
+	return result
+}
+
+// isSSHDProcess returns true if process with given PID is sshd process
+func isSSHDProcess(pid int) bool {
+	if pid <= 1 {
+		return false
+	}
+
+	data, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/comm")
+
+	if err != nil {
+		return false
+	}
+
+	comm := strings.TrimSpace(string(data))
+
+	for _, name := range sshdProcesses {
+		if comm == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// getParentPID returns PID of parent process
+func getParentPID(pid int) int {
+	data, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+
+	if err != nil {
+		return -1
+	}
+
+	// Process name can contain spaces and brackets, so fields are parsed
+	// after its closing bracket
+	stat := string(data)
+	fields := strings.Fields(stat[strings.LastIndex(stat, ")")+1:])
+
+	if len(fields) < 2 {
+		return -1
+	}
+
+	ppid, err := strconv.Atoi(fields[1])
+
+	if err != nil {
+		return -1
+	}
+
+	return ppid
+}
+
+// isAccountLocked returns true if account password is locked
+func isAccountLocked(user string) (bool, error) {
+	output, err := exec.Command("passwd", "-S", user).Output()
+
+	if err != nil {
+		return false, fmt.Errorf("Can't get status of account %s: %v", user, err)
+	}
+
+	fields := strings.Fields(string(output))
+
+	if len(fields) < 2 {
+		return false, fmt.Errorf("Can't parse status of account %s", user)
+	}
+
+	return fields[1] == "L" || fields[1] == "LK", nil
+}
@@ -0,0 +1,305 @@
+package daemon
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+//                                                                                    //
+//                         Copyright (c) 2022 ESSENTIAL KAOS                          //
+//      Apache License, Version 2.0 <https://www.apache.org/licenses/LICENSE-2.0>     //
+//                                                                                    //
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/essentialkaos/ek/v12/fsutil"
+	"github.com/essentialkaos/ek/v12/jsonutil"
+	"github.com/essentialkaos/ek/v12/log"
+)
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// Transaction kinds
+const (
+	TX_ENABLE  = "enable"
+	TX_DISABLE = "disable"
+)
+
+// STEP_MARKER is name of step which creates or removes bastion marker
+const STEP_MARKER = "marker"
+
+// TX_REPLAY_ATTEMPTS is number of attempts to replay interrupted transaction
+const TX_REPLAY_ATTEMPTS = 3
+
+// TX_REPLAY_DELAY is delay between attempts to replay transaction
+const TX_REPLAY_DELAY = 5 * time.Second
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+var (
+	// ErrTxRolledBack is returned if enabling failed and all changes were reverted
+	ErrTxRolledBack = errors.New("Bastion mode enabling failed, all changes were rolled back")
+
+	// ErrTxNotFinished is returned if transaction failed and its journal is kept
+	// for next attempt
+	ErrTxNotFinished = errors.New("Transaction is not finished, journal is kept for next attempt")
+)
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// Journal contains info about planned and completed steps of transaction
+type Journal struct {
+	Kind     string   `json:"kind"`
+	Duration int64    `json:"duration"`
+	Trigger  *Trigger `json:"trigger,omitempty"`
+	Started  int64    `json:"started"`
+	Planned  []string `json:"planned"`
+	Done     []string `json:"done"`
+}
+
+// txStep is single step of transaction
+type txStep struct {
+	Name     string
+	Run      func() error
+	AfterAll bool // Step runs only if all previous steps succeeded
+}
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// beginTransaction creates journal with planned steps
+func beginTransaction(kind string, duration int64, trigger *Trigger) (*Journal, []txStep, error) {
+	steps := getTxSteps(kind, duration, trigger)
+	journal := &Journal{
+		Kind:     kind,
+		Duration: duration,
+		Trigger:  trigger,
+		Started:  time.Now().Unix(),
+	}
+
+	for _, step := range steps {
+		journal.Planned = append(journal.Planned, step.Name)
+	}
+
+	return journal, steps, journal.Save()
+}
+
+// recoverTransaction finishes or rolls back transaction interrupted by crash
+func recoverTransaction() error {
+	if !fsutil.IsExist(getStatePath(JOURNAL_FILE)) {
+		return nil
+	}
+
+	journal := &Journal{}
+	err := jsonutil.Read(getStatePath(JOURNAL_FILE), journal)
+
+	if err != nil {
+		return fmt.Errorf("Can't read journal: %v", err)
+	}
+
+	log.Warn(
+		"[IMPORTANT] Found unfinished \"%s\" transaction (%d of %d steps done), recovering...",
+		journal.Kind, len(journal.Done), len(journal.Planned),
+	)
+
+	switch journal.Kind {
+	case TX_ENABLE:
+		if journal.Replay(getTxSteps(TX_ENABLE, journal.Duration, journal.Trigger)) {
+			return journal.Finish()
+		}
+
+		return rollbackTransaction()
+
+	case TX_DISABLE:
+		if journal.Replay(getTxSteps(TX_DISABLE, 0, nil)) {
+			return journal.Finish()
+		}
+
+		return fmt.Errorf("Can't finish \"%s\" transaction: %w", TX_DISABLE, ErrTxNotFinished)
+	}
+
+	return fmt.Errorf("Journal contains unknown transaction kind \"%s\"", journal.Kind)
+}
+
+// runTransaction runs transaction with journaling, failed enabling is rolled
+// back, journal of failed disabling is kept, so it is retried later or after
+// restart
+func runTransaction(kind string, duration int64, trigger *Trigger) error {
+	journal, steps, err := beginTransaction(kind, duration, trigger)
+
+	if err != nil {
+		log.Error(err.Error())
+	}
+
+	if journal.Replay(steps) {
+		err = journal.Finish()
+
+		if err != nil {
+			log.Error(err.Error())
+		}
+
+		return nil
+	}
+
+	if kind == TX_DISABLE {
+		return fmt.Errorf("Can't finish \"%s\" transaction: %w", TX_DISABLE, ErrTxNotFinished)
+	}
+
+	err = rollbackTransaction()
+
+	if err != nil {
+		return err
+	}
+
+	return ErrTxRolledBack
+}
+
+// rollbackTransaction reverts all changes of failed enabling
+func rollbackTransaction() error {
+	log.Warn("[IMPORTANT] Can't finish \"%s\" transaction, rolling back...", TX_ENABLE)
+
+	journal, steps, err := beginTransaction(TX_DISABLE, 0, nil)
+
+	if err != nil {
+		log.Error(err.Error())
+	}
+
+	if !journal.Replay(steps) {
+		return fmt.Errorf("Can't roll back \"%s\" transaction: %w", TX_ENABLE, ErrTxNotFinished)
+	}
+
+	return journal.Finish()
+}
+
+// getTxSteps returns ordered steps for transaction of given kind
+func getTxSteps(kind string, duration int64, trigger *Trigger) []txStep {
+	var steps []txStep
+
+	if kind == TX_ENABLE {
+		steps = append(steps, txStep{Name: STEP_MARKER, Run: func() error {
+			_, err := createBastionMarker(duration, trigger)
+			return err
+		}})
+
+		for _, action := range getActions(trigger.GetProfile()) {
+			action := action
+			steps = append(steps, txStep{Name: action.Name, Run: func() error {
+				return applyAction(action)
+			}})
+		}
+
+		return steps
+	}
+
+	// Marker can be invalid, in this case all configured actions will be reverted
+	marker, _ := getBastionMarkerInfo()
+
+	for _, action := range getRevertOrder(getMarkerActions(marker)) {
+		action := action
+		steps = append(steps, txStep{
+			Name: action.Name,
+			Run:  func() error { return revertAction(action, marker) },
+			// Bastion must start on boot until access to server is restored
+			AfterAll: action.Name == ACTION_ENABLE_BASTION,
+		})
+	}
+
+	// Marker is kept until all actions are reverted, so bastion mode is
+	// restored after restart instead of leaving server half-locked
+	steps = append(steps, txStep{Name: STEP_MARKER, Run: removeBastionMarker, AfterAll: true})
+
+	return steps
+}
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// Run runs all not completed steps and returns true if all steps succeeded
+func (j *Journal) Run(steps []txStep) bool {
+	ok := true
+
+	for _, step := range steps {
+		if j.IsDone(step.Name) {
+			continue
+		}
+
+		if step.AfterAll && !ok {
+			log.Warn("Step \"%s\" of \"%s\" transaction skipped due to failed steps", step.Name, j.Kind)
+			continue
+		}
+
+		err := step.Run()
+
+		if err != nil {
+			log.Error("Step \"%s\" of \"%s\" transaction failed: %v", step.Name, j.Kind, err)
+			ok = false
+			continue
+		}
+
+		j.Done = append(j.Done, step.Name)
+
+		err = j.Save()
+
+		if err != nil {
+			log.Error(err.Error())
+		}
+	}
+
+	return ok
+}
+
+// Replay runs not completed steps of transaction several times, all steps
+// are idempotent, so failed steps can be safely retried
+func (j *Journal) Replay(steps []txStep) bool {
+	for attempt := 1; attempt <= TX_REPLAY_ATTEMPTS; attempt++ {
+		if j.Run(steps) {
+			if attempt > 1 {
+				log.Info("Transaction \"%s\" finished on attempt %d", j.Kind, attempt)
+			}
+
+			return true
+		}
+
+		if attempt < TX_REPLAY_ATTEMPTS {
+			log.Warn(
+				"Transaction \"%s\" attempt %d/%d failed, retrying...",
+				j.Kind, attempt, TX_REPLAY_ATTEMPTS,
+			)
+			time.Sleep(TX_REPLAY_DELAY)
+		}
+	}
+
+	return false
+}
+
+// IsDone returns true if step with given name is completed
+func (j *Journal) IsDone(name string) bool {
+	for _, step := range j.Done {
+		if step == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Save writes journal to disk
+func (j *Journal) Save() error {
+	err := writeJSONAtomic(getStatePath(JOURNAL_FILE), j)
+
+	if err != nil {
+		return fmt.Errorf("Can't save journal: %v", err)
+	}
+
+	return nil
+}
+
+// Finish removes journal
+func (j *Journal) Finish() error {
+	err := os.Remove(getStatePath(JOURNAL_FILE))
+
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Can't remove journal: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,350 @@
+package daemon
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+//                                                                                    //
+//                         Copyright (c) 2022 ESSENTIAL KAOS                          //
+//      Apache License, Version 2.0 <https://www.apache.org/licenses/LICENSE-2.0>     //
+//                                                                                    //
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/essentialkaos/ek/v12/fsutil"
+	"github.com/essentialkaos/ek/v12/jsonutil"
+)
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// MARKER_VERSION is current version of marker format
+const MARKER_VERSION = 2
+
+// Marker policies
+const (
+	POLICY_FAIL_CLOSED = "fail-closed"
+	POLICY_FAIL_OPEN   = "fail-open"
+)
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// BastionMarker contains info about bastion mode
+type BastionMarker struct {
+	Version   int             `json:"version"`
+	Started   int64           `json:"started"`
+	Until     int64           `json:"until"`
+	Duration  int64           `json:"duration"`
+	Elapsed   int64           `json:"elapsed"`
+	BootID    string          `json:"boot_id"`
+	Uptime    int64           `json:"uptime"`
+	Source    string          `json:"source"`
+	Actor     string          `json:"actor"`
+	Reason    string          `json:"reason"`
+	Profile   string          `json:"profile,omitempty"`
+	Actions   []*MarkerAction `json:"actions"`
+	Accounts  []*AccountState `json:"accounts,omitempty"`
+	Signature string          `json:"signature"`
+}
+
+// MarkerAction contains info about applied action and state before applying
+type MarkerAction struct {
+	Name         string `json:"name"`
+	PriorApplied bool   `json:"prior_applied"`
+}
+
+// AccountState contains lock and expiration date of account before locking
+type AccountState struct {
+	User   string `json:"user"`
+	Locked bool   `json:"locked"`
+	Expire string `json:"expire"` // Days since epoch or empty
+}
+
+// Trigger contains info about source of bastion mode activation
+type Trigger struct {
+	Source  string `json:"source"`
+	Actor   string `json:"actor"`
+	Reason  string `json:"reason"`
+	Profile string `json:"profile,omitempty"`
+}
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// ErrMarkerInvalid is returned if marker is malformed or has wrong signature
+var ErrMarkerInvalid = errors.New("Bastion marker is malformed or tampered")
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// GetAction returns info about applied action with given name
+func (m *BastionMarker) GetAction(name string) *MarkerAction {
+	for _, action := range m.Actions {
+		if action.Name == name {
+			return action
+		}
+	}
+
+	return nil
+}
+
+// GetAccount returns info about state of account before locking
+func (m *BastionMarker) GetAccount(user string) *AccountState {
+	for _, account := range m.Accounts {
+		if account.User == user {
+			return account
+		}
+	}
+
+	return nil
+}
+
+// Sign calculates marker signature
+func (m *BastionMarker) Sign(key []byte) error {
+	signature, err := m.calcSignature(key)
+
+	if err != nil {
+		return err
+	}
+
+	m.Signature = signature
+
+	return nil
+}
+
+// IsValid returns true if marker has valid signature
+func (m *BastionMarker) IsValid(key []byte) bool {
+	if m.Version != MARKER_VERSION || m.Signature == "" {
+		return false
+	}
+
+	signature, err := m.calcSignature(key)
+
+	if err != nil {
+		return false
+	}
+
+	return hmac.Equal([]byte(signature), []byte(m.Signature))
+}
+
+// calcSignature calculates HMAC of marker data
+func (m *BastionMarker) calcSignature(key []byte) (string, error) {
+	marker := *m
+	marker.Signature = ""
+
+	data, err := json.Marshal(marker)
+
+	if err != nil {
+		return "", err
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// GetProfile returns name of lockdown profile requested by trigger or name
+// of default profile
+func (t *Trigger) GetProfile() string {
+	if t == nil || t.Profile == "" {
+		return getDefaultProfileName()
+	}
+
+	return t.Profile
+}
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// createBastionMarker create file with info about bastion mode
+func createBastionMarker(duration int64, trigger *Trigger) (*BastionMarker, error) {
+	now := time.Now().Unix()
+	marker := &BastionMarker{
+		Version:  MARKER_VERSION,
+		Started:  now,
+		Until:    now + duration,
+		Duration: duration,
+		BootID:   getBootID(),
+		Uptime:   getUptime(),
+		Profile:  trigger.GetProfile(),
+	}
+
+	if trigger != nil {
+		marker.Source = trigger.Source
+		marker.Actor = trigger.Actor
+		marker.Reason = trigger.Reason
+	}
+
+	return marker, saveBastionMarker(marker)
+}
+
+// renewBastionMarker replace invalid marker with a new one, all actions
+// will be reverted on bastion mode end; marker is returned even if it can't
+// be saved, so bastion mode can be kept using marker from memory
+func renewBastionMarker(duration int64, trigger *Trigger) (*BastionMarker, error) {
+	now := time.Now().Unix()
+	marker := &BastionMarker{
+		Version:  MARKER_VERSION,
+		Started:  now,
+		Until:    now + duration,
+		Duration: duration,
+		BootID:   getBootID(),
+		Uptime:   getUptime(),
+		Source:   trigger.Source,
+		Actor:    trigger.Actor,
+		Reason:   trigger.Reason,
+		Profile:  trigger.GetProfile(),
+	}
+
+	for _, action := range getActions(marker.Profile) {
+		marker.Actions = append(marker.Actions, &MarkerAction{action.Name, false})
+	}
+
+	// Invalid marker can be signed by removed key
+	if !fsutil.IsExist(getStatePath(KEY_FILE)) {
+		_, err := createMarkerKey()
+
+		if err != nil {
+			return marker, err
+		}
+	}
+
+	return marker, saveBastionMarker(marker)
+}
+
+// saveBastionMarker sign and write marker to file
+func saveBastionMarker(marker *BastionMarker) error {
+	key, err := getMarkerKey()
+
+	if err != nil {
+		return err
+	}
+
+	err = marker.Sign(key)
+
+	if err != nil {
+		return fmt.Errorf("Can't sign bastion marker: %v", err)
+	}
+
+	err = writeJSONAtomic(getStatePath(MARKER_FILE), marker)
+
+	if err != nil {
+		return fmt.Errorf("Can't encode bastion marker: %v", err)
+	}
+
+	return nil
+}
+
+// addMarkerAction add info about applied action to marker
+func addMarkerAction(name string, priorApplied bool) error {
+	marker, err := getBastionMarkerInfo()
+
+	if err != nil {
+		return err
+	}
+
+	if marker.GetAction(name) != nil {
+		return nil
+	}
+
+	marker.Actions = append(marker.Actions, &MarkerAction{name, priorApplied})
+
+	return saveBastionMarker(marker)
+}
+
+// removeBastionMarker remove file with info about bastion mode
+func removeBastionMarker() error {
+	if !isBastionMarkerExist() {
+		return nil
+	}
+
+	err := os.Remove(getStatePath(MARKER_FILE))
+
+	if err != nil {
+		return fmt.Errorf("Can't remove bastion marker: %v", err)
+	}
+
+	return nil
+}
+
+// getBastionMarkerInfo read, decode and verify bastion marker
+func getBastionMarkerInfo() (*BastionMarker, error) {
+	marker := &BastionMarker{}
+
+	err := jsonutil.Read(getStatePath(MARKER_FILE), marker)
+
+	if err != nil {
+		return nil, ErrMarkerInvalid
+	}
+
+	key, err := getMarkerKey()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !marker.IsValid(key) {
+		return nil, ErrMarkerInvalid
+	}
+
+	return marker, nil
+}
+
+// isBastionMarkerExist return true if bastion marker file exist
+func isBastionMarkerExist() bool {
+	return fsutil.IsExist(getStatePath(MARKER_FILE))
+}
+
+// getMarkerKey read key for marker signing, new key is generated only if there
+// is no marker
+func getMarkerKey() ([]byte, error) {
+	file := getStatePath(KEY_FILE)
+
+	if !fsutil.IsExist(file) {
+		// Marker without key can't be verified, so it can be forged
+		if isBastionMarkerExist() {
+			return nil, ErrMarkerInvalid
+		}
+
+		return createMarkerKey()
+	}
+
+	data, err := os.ReadFile(file)
+
+	if err != nil {
+		return nil, fmt.Errorf("Can't read marker key: %v", err)
+	}
+
+	key := strings.TrimSpace(string(data))
+
+	if key == "" {
+		return nil, fmt.Errorf("Marker key file %s is empty", file)
+	}
+
+	return []byte(key), nil
+}
+
+// createMarkerKey generate and save new key for marker signing
+func createMarkerKey() ([]byte, error) {
+	file := getStatePath(KEY_FILE)
+	buf := make([]byte, 32)
+	_, err := rand.Read(buf)
+
+	if err != nil {
+		return nil, fmt.Errorf("Can't generate marker key: %v", err)
+	}
+
+	key := hex.EncodeToString(buf)
+	err = writeFileAtomic(file, []byte(key+"\n"), 0600)
+
+	if err != nil {
+		return nil, fmt.Errorf("Can't save marker key: %v", err)
+	}
+
+	return []byte(key), nil
+}
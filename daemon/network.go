@@ -0,0 +1,367 @@
+package daemon
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+//                                                                                    //
+//                         Copyright (c) 2022 ESSENTIAL KAOS                          //
+//      Apache License, Version 2.0 <https://www.apache.org/licenses/LICENSE-2.0>     //
+//                                                                                    //
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/essentialkaos/ek/v12/knf"
+	"github.com/essentialkaos/ek/v12/log"
+
+	"github.com/valyala/fasthttp"
+)
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+const (
+	// PROXY_HEADER_TIMEOUT is timeout for reading PROXY protocol header
+	PROXY_HEADER_TIMEOUT = 5 * time.Second
+
+	// PROXY_HANDOFF_TIMEOUT is timeout for passing accepted connection to
+	// HTTP server
+	PROXY_HANDOFF_TIMEOUT = 5 * time.Second
+
+	// ACCEPT_MIN_DELAY is initial delay before next accept after temporary error
+	ACCEPT_MIN_DELAY = 5 * time.Millisecond
+
+	// ACCEPT_MAX_DELAY is maximum delay before next accept after temporary error
+	ACCEPT_MAX_DELAY = time.Second
+)
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// proxyListener is listener with PROXY protocol (v1) support
+type proxyListener struct {
+	net.Listener
+	conns chan net.Conn
+	errs  chan error
+}
+
+// proxyConn is connection with address from PROXY protocol header
+type proxyConn struct {
+	net.Conn
+	reader     *bufio.Reader
+	remoteAddr net.Addr
+}
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+var (
+	allowedNets    []*net.IPNet
+	trustedProxies []*net.IPNet
+
+	// netMx guards allowlist and trusted proxies which can be changed
+	// by configuration reload
+	netMx sync.RWMutex
+)
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// newProxyListener creates new listener with PROXY protocol support
+func newProxyListener(ln net.Listener) *proxyListener {
+	l := &proxyListener{
+		Listener: ln,
+		conns:    make(chan net.Conn),
+		errs:     make(chan error, 1),
+	}
+
+	go l.acceptLoop()
+
+	return l
+}
+
+// Accept waits for and returns the next connection to the listener
+func (l *proxyListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case err := <-l.errs:
+		return nil, err
+	}
+}
+
+// acceptLoop accepts connections and reads PROXY headers without blocking
+// other clients, temporary errors (e.g. too many open files) are retried
+// with growing delay
+func (l *proxyListener) acceptLoop() {
+	var delay time.Duration
+
+	for {
+		conn, err := l.Listener.Accept()
+
+		if err != nil {
+			if !isTemporaryError(err) {
+				l.errs <- err
+				return
+			}
+
+			delay = getAcceptDelay(delay)
+			log.Warn("Can't accept connection: %v (retrying in %v)", err, delay)
+			time.Sleep(delay)
+			continue
+		}
+
+		delay = 0
+
+		go l.processConn(conn)
+	}
+}
+
+// processConn reads PROXY header from connections from trusted proxies
+func (l *proxyListener) processConn(conn net.Conn) {
+	addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+
+	if !ok || !isNetsContains(getTrustedProxies(), addr.IP) {
+		l.handoff(conn)
+		return
+	}
+
+	pConn := &proxyConn{Conn: conn, reader: bufio.NewReader(conn)}
+
+	err := conn.SetReadDeadline(time.Now().Add(PROXY_HEADER_TIMEOUT))
+
+	if err != nil {
+		log.Warn("Can't set deadline for reading PROXY header from %s: %v", addr.String(), err)
+		conn.Close()
+		return
+	}
+
+	remoteAddr, err := readProxyHeader(pConn.reader)
+	conn.SetReadDeadline(time.Time{})
+
+	if err != nil {
+		log.Warn("Can't read PROXY header from %s: %v", addr.String(), err)
+		conn.Close()
+		return
+	}
+
+	pConn.remoteAddr = remoteAddr
+
+	l.handoff(pConn)
+}
+
+// handoff passes connection to HTTP server, connection is closed if server
+// doesn't accept it in time (e.g. server is stopped)
+func (l *proxyListener) handoff(conn net.Conn) {
+	timer := time.NewTimer(PROXY_HANDOFF_TIMEOUT)
+	defer timer.Stop()
+
+	select {
+	case l.conns <- conn:
+		// connection accepted
+	case <-timer.C:
+		log.Warn("Connection from %s closed: HTTP server didn't accept it in time", conn.RemoteAddr())
+		conn.Close()
+	}
+}
+
+// Read reads data from the connection
+func (c *proxyConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// RemoteAddr returns the remote network address from PROXY header
+func (c *proxyConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// isTemporaryError returns true if accept error is temporary and listener
+// can be used further
+func isTemporaryError(err error) bool {
+	var netErr net.Error
+
+	// Temporary is deprecated, but it is still the only way to detect EMFILE
+	// and ENFILE errors in Go 1.18 (net/http does the same)
+	return errors.As(err, &netErr) && netErr.Temporary()
+}
+
+// getAcceptDelay returns delay before next accept
+func getAcceptDelay(delay time.Duration) time.Duration {
+	if delay == 0 {
+		return ACCEPT_MIN_DELAY
+	}
+
+	delay *= 2
+
+	if delay > ACCEPT_MAX_DELAY {
+		return ACCEPT_MAX_DELAY
+	}
+
+	return delay
+}
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// configureNetwork parse allowlist and trusted proxies from configuration
+func configureNetwork() error {
+	allowed, err := parseNetList(knf.GetS(SERVER_ALLOW))
+
+	if err != nil {
+		return fmt.Errorf("Can't parse allowlist: %v", err)
+	}
+
+	proxies, err := parseNetList(knf.GetS(SERVER_TRUSTED_PROXIES))
+
+	if err != nil {
+		return fmt.Errorf("Can't parse trusted proxies list: %v", err)
+	}
+
+	netMx.Lock()
+	allowedNets, trustedProxies = allowed, proxies
+	netMx.Unlock()
+
+	return nil
+}
+
+// getAllowedNets returns allowlist
+func getAllowedNets() []*net.IPNet {
+	netMx.RLock()
+	defer netMx.RUnlock()
+
+	return allowedNets
+}
+
+// getTrustedProxies returns list of trusted proxies
+func getTrustedProxies() []*net.IPNet {
+	netMx.RLock()
+	defer netMx.RUnlock()
+
+	return trustedProxies
+}
+
+// getClientIP returns client IP address using X-Forwarded-For header from
+// trusted proxies
+func getClientIP(ctx *fasthttp.RequestCtx) net.IP {
+	ip := ctx.RemoteIP()
+	proxies := getTrustedProxies()
+
+	if !isNetsContains(proxies, ip) {
+		return ip
+	}
+
+	forwarded := strings.Split(string(ctx.Request.Header.Peek("X-Forwarded-For")), ",")
+
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		fip := net.ParseIP(strings.TrimSpace(forwarded[i]))
+
+		if fip == nil {
+			break
+		}
+
+		ip = fip
+
+		if !isNetsContains(proxies, ip) {
+			break
+		}
+	}
+
+	return ip
+}
+
+// isAllowedClient returns true if client with given IP is allowed to trigger
+// or control bastion
+func isAllowedClient(ip net.IP) bool {
+	nets := getAllowedNets()
+
+	if len(nets) == 0 {
+		return true
+	}
+
+	return isNetsContains(nets, ip)
+}
+
+// isNetsContains returns true if one of given networks contains IP
+func isNetsContains(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseNetList parses list of CIDRs or IPs separated by spaces or commas
+func parseNetList(data string) ([]*net.IPNet, error) {
+	var result []*net.IPNet
+
+	for _, item := range strings.FieldsFunc(data, isListSeparator) {
+		if !strings.Contains(item, "/") {
+			if strings.Contains(item, ":") {
+				item += "/128"
+			} else {
+				item += "/32"
+			}
+		}
+
+		_, n, err := net.ParseCIDR(item)
+
+		if err != nil {
+			return nil, fmt.Errorf("\"%s\" is not a valid CIDR or IP", item)
+		}
+
+		result = append(result, n)
+	}
+
+	return result, nil
+}
+
+// readProxyHeader reads PROXY protocol v1 header and returns source address
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	line, err := r.ReadString('\n')
+
+	if err != nil {
+		return nil, err
+	}
+
+	fields := strings.Fields(line)
+
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, fmt.Errorf("Header is malformed")
+	}
+
+	if fields[1] == "UNKNOWN" || len(fields) != 6 {
+		return nil, fmt.Errorf("Unsupported header \"%s\"", strings.TrimSpace(line))
+	}
+
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("Header contains invalid source address")
+	}
+
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+// isListSeparator returns true if given rune is list separator
+func isListSeparator(r rune) bool {
+	return r == ' ' || r == ',' || r == '\t'
+}
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// validateNetList is knf validator for lists of CIDRs
+func validateNetList(config *knf.Config, prop string, value interface{}) error {
+	_, err := parseNetList(config.GetS(prop))
+
+	if err != nil {
+		return fmt.Errorf("Property %s contains invalid value: %v", prop, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,241 @@
+package daemon
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+//                                                                                    //
+//                         Copyright (c) 2022 ESSENTIAL KAOS                          //
+//      Apache License, Version 2.0 <https://www.apache.org/licenses/LICENSE-2.0>     //
+//                                                                                    //
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+func TestReadProxyHeader(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		addr   string
+		isErr  bool
+	}{
+		{"tcp4", "PROXY TCP4 192.0.2.10 192.0.2.1 51000 17491\r\n", "192.0.2.10:51000", false},
+		{"tcp6", "PROXY TCP6 2001:db8::10 2001:db8::1 51000 17491\r\n", "[2001:db8::10]:51000", false},
+		{"lf only", "PROXY TCP4 192.0.2.10 192.0.2.1 51000 17491\n", "192.0.2.10:51000", false},
+		{"unknown", "PROXY UNKNOWN\r\n", "", true},
+		{"unknown with addresses", "PROXY UNKNOWN 192.0.2.10 192.0.2.1 51000 17491\r\n", "", true},
+		{"not proxy", "GET / HTTP/1.1\r\n", "", true},
+		{"lowercase", "proxy TCP4 192.0.2.10 192.0.2.1 51000 17491\r\n", "", true},
+		{"short", "PROXY\r\n", "", true},
+		{"missing port", "PROXY TCP4 192.0.2.10 192.0.2.1 51000\r\n", "", true},
+		{"extra field", "PROXY TCP4 192.0.2.10 192.0.2.1 51000 17491 1\r\n", "", true},
+		{"invalid ip", "PROXY TCP4 192.0.2.300 192.0.2.1 51000 17491\r\n", "", true},
+		{"invalid port", "PROXY TCP4 192.0.2.10 192.0.2.1 port 17491\r\n", "", true},
+		{"no line end", "PROXY TCP4 192.0.2.10 192.0.2.1 51000 17491", "", true},
+		{"empty", "", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, err := readProxyHeader(bufio.NewReader(strings.NewReader(tt.header)))
+
+			if tt.isErr {
+				if err == nil {
+					t.Fatalf("Expected error, got address %v", addr)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if addr.String() != tt.addr {
+				t.Fatalf("Unexpected address %s, expected %s", addr, tt.addr)
+			}
+		})
+	}
+}
+
+func TestGetClientIP(t *testing.T) {
+	tests := []struct {
+		name      string
+		remoteIP  string
+		proxies   string
+		forwarded string
+		clientIP  string
+	}{
+		{"no proxies", "192.0.2.10", "", "198.51.100.1", "192.0.2.10"},
+		{"untrusted remote", "192.0.2.10", "10.0.0.0/8", "198.51.100.1", "192.0.2.10"},
+		{"trusted proxy", "10.0.0.1", "10.0.0.0/8", "198.51.100.1", "198.51.100.1"},
+		{"no header", "10.0.0.1", "10.0.0.0/8", "", "10.0.0.1"},
+		{"proxy chain", "10.0.0.1", "10.0.0.0/8", "198.51.100.1, 10.0.0.2, 10.0.0.3", "198.51.100.1"},
+		{"spoofed first hop", "10.0.0.1", "10.0.0.0/8", "127.0.0.1, 198.51.100.1", "198.51.100.1"},
+		{"invalid hop", "10.0.0.1", "10.0.0.0/8", "198.51.100.1, unknown", "10.0.0.1"},
+		{"invalid hop after client", "10.0.0.1", "10.0.0.0/8", "unknown, 198.51.100.1", "198.51.100.1"},
+		{"only proxies", "10.0.0.1", "10.0.0.0/8", "10.0.0.2, 10.0.0.3", "10.0.0.2"},
+		{"ipv6", "2001:db8::1", "2001:db8::/32", "2001:db8:1::10, 2001:db8::2", "2001:db8:1::10"},
+	}
+
+	defer func() { trustedProxies = nil }()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxies, err := parseNetList(tt.proxies)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			netMx.Lock()
+			trustedProxies = proxies
+			netMx.Unlock()
+
+			req := &fasthttp.Request{}
+
+			if tt.forwarded != "" {
+				req.Header.Set("X-Forwarded-For", tt.forwarded)
+			}
+
+			ctx := &fasthttp.RequestCtx{}
+			ctx.Init(req, &net.TCPAddr{IP: net.ParseIP(tt.remoteIP), Port: 51000}, nil)
+
+			ip := getClientIP(ctx)
+
+			if !ip.Equal(net.ParseIP(tt.clientIP)) {
+				t.Fatalf("Unexpected client IP %s, expected %s", ip, tt.clientIP)
+			}
+		})
+	}
+}
+
+func TestParseNetList(t *testing.T) {
+	tests := []struct {
+		name  string
+		data  string
+		nets  []string
+		isErr bool
+	}{
+		{"empty", "", nil, false},
+		{"ip", "192.0.2.10", []string{"192.0.2.10/32"}, false},
+		{"ipv6", "2001:db8::1", []string{"2001:db8::1/128"}, false},
+		{"separators", "10.0.0.0/8, 192.0.2.10\t2001:db8::/32", []string{"10.0.0.0/8", "192.0.2.10/32", "2001:db8::/32"}, false},
+		{"invalid ip", "192.0.2.300", nil, true},
+		{"invalid mask", "10.0.0.0/33", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nets, err := parseNetList(tt.data)
+
+			if tt.isErr != (err != nil) {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if len(nets) != len(tt.nets) {
+				t.Fatalf("Unexpected networks %v, expected %v", nets, tt.nets)
+			}
+
+			for i, n := range nets {
+				if n.String() != tt.nets[i] {
+					t.Errorf("Unexpected network %s, expected %s", n, tt.nets[i])
+				}
+			}
+		})
+	}
+}
+
+func TestProxyListenerTemporaryErrors(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	ln := newProxyListener(&testListener{
+		errs:   []error{&net.OpError{Op: "accept", Net: "tcp", Err: syscall.EMFILE}},
+		conns:  []net.Conn{server},
+		closed: make(chan struct{}),
+	})
+
+	conn, err := ln.Accept()
+
+	if err != nil {
+		t.Fatalf("Temporary error must be retried, got: %v", err)
+	}
+
+	if conn != server {
+		t.Fatalf("Unexpected connection %v", conn)
+	}
+
+	ln.Close()
+
+	_, err = ln.Accept()
+
+	if err != net.ErrClosed {
+		t.Fatalf("Unexpected error %v, expected %v", err, net.ErrClosed)
+	}
+}
+
+func TestGetAcceptDelay(t *testing.T) {
+	var delay time.Duration
+
+	for _, expected := range []time.Duration{
+		5 * time.Millisecond, 10 * time.Millisecond, 20 * time.Millisecond,
+	} {
+		delay = getAcceptDelay(delay)
+
+		if delay != expected {
+			t.Fatalf("Unexpected delay %v, expected %v", delay, expected)
+		}
+	}
+
+	if getAcceptDelay(800*time.Millisecond) != ACCEPT_MAX_DELAY {
+		t.Fatalf("Delay must be limited by %v", ACCEPT_MAX_DELAY)
+	}
+}
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// testListener is listener which returns given errors, then given connections
+// and then net.ErrClosed after closing
+type testListener struct {
+	errs   []error
+	conns  []net.Conn
+	closed chan struct{}
+}
+
+// Accept returns next error or connection
+func (l *testListener) Accept() (net.Conn, error) {
+	switch {
+	case len(l.errs) != 0:
+		err := l.errs[0]
+		l.errs = l.errs[1:]
+		return nil, err
+	case len(l.conns) != 0:
+		conn := l.conns[0]
+		l.conns = l.conns[1:]
+		return conn, nil
+	}
+
+	<-l.closed
+
+	return nil, net.ErrClosed
+}
+
+// Close closes listener
+func (l *testListener) Close() error {
+	close(l.closed)
+	return nil
+}
+
+// Addr returns listener address
+func (l *testListener) Addr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 17491}
+}
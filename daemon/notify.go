@@ -0,0 +1,93 @@
+package daemon
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+//                                                                                    //
+//                         Copyright (c) 2022 ESSENTIAL KAOS                          //
+//      Apache License, Version 2.0 <https://www.apache.org/licenses/LICENSE-2.0>     //
+//                                                                                    //
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/essentialkaos/ek/v12/knf"
+	"github.com/essentialkaos/ek/v12/log"
+
+	"github.com/valyala/fasthttp"
+)
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// NOTIFY_TIMEOUT is timeout for sending notification
+const NOTIFY_TIMEOUT = 10 * time.Second
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// Notification contains info about event
+type Notification struct {
+	Event   string            `json:"event"`
+	Host    string            `json:"host"`
+	Message string            `json:"message"`
+	Time    int64             `json:"time"`
+	Fields  map[string]string `json:"fields,omitempty"`
+}
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// sendNotification asynchronously sends notification to configured webhook
+func sendNotification(event, message string, fields map[string]string) {
+	url := knf.GetS(NOTIFY_URL)
+
+	if url == "" {
+		return
+	}
+
+	hostname, _ := os.Hostname()
+
+	n := &Notification{
+		Event:   event,
+		Host:    hostname,
+		Message: message,
+		Time:    time.Now().Unix(),
+		Fields:  fields,
+	}
+
+	go postNotification(url, n)
+}
+
+// postNotification sends notification to webhook
+func postNotification(url string, n *Notification) {
+	data, err := json.Marshal(n)
+
+	if err != nil {
+		log.Error("Can't encode notification: %v", err)
+		return
+	}
+
+	req := fasthttp.AcquireRequest()
+	resp := fasthttp.AcquireResponse()
+
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(resp)
+
+	req.SetRequestURI(url)
+	req.Header.SetMethod(fasthttp.MethodPost)
+	req.Header.SetContentType("application/json")
+	req.SetBody(data)
+
+	err = fasthttp.DoTimeout(req, resp, NOTIFY_TIMEOUT)
+
+	if err != nil {
+		log.Error("Can't send notification about \"%s\" event: %v", n.Event, err)
+		return
+	}
+
+	if resp.StatusCode() >= 300 {
+		log.Error(
+			"Can't send notification about \"%s\" event: webhook returned status code %d",
+			n.Event, resp.StatusCode(),
+		)
+	}
+}
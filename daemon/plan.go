@@ -0,0 +1,260 @@
+package daemon
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+//                                                                                    //
+//                         Copyright (c) 2022 ESSENTIAL KAOS                          //
+//      Apache License, Version 2.0 <https://www.apache.org/licenses/LICENSE-2.0>     //
+//                                                                                    //
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/essentialkaos/ek/v12/fmtc"
+	"github.com/essentialkaos/ek/v12/fsutil"
+	"github.com/essentialkaos/ek/v12/initsystem"
+	"github.com/essentialkaos/ek/v12/knf"
+	"github.com/essentialkaos/ek/v12/log"
+)
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// Plan contains ordered steps which bastion mode enabling and disabling
+// would perform
+type Plan struct {
+	Profile    string
+	InitSystem string
+	Active     bool
+	Enable     []*PlanStep
+	Disable    []*PlanStep
+}
+
+// PlanStep is single step of plan
+type PlanStep struct {
+	Name string
+	Desc string
+	Note string
+}
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// buildPlan inspects current system state and creates plan for given profile
+// without changing anything
+func buildPlan(profile string) (*Plan, error) {
+	p, err := getProfile(profile)
+
+	if err != nil {
+		return nil, err
+	}
+
+	actions, err := getProfileActions(p.Name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	plan := &Plan{Profile: p.Name, InitSystem: getInitSystemName()}
+	marker := getPlanMarker()
+	priorApplied := make(map[string]bool)
+
+	plan.Active = marker != nil
+
+	plan.Enable = appendScriptStep(plan.Enable, SCRIPT_BEFORE)
+	plan.Enable = append(plan.Enable, &PlanStep{
+		STEP_MARKER, "Create bastion marker " + getStatePath(MARKER_FILE), "",
+	})
+
+	for _, action := range actions {
+		step := &PlanStep{Name: action.Name, Desc: describeAction(action.Name, false)}
+		applied, err := action.Check()
+
+		switch {
+		case err != nil:
+			step.Note = fmt.Sprintf("can't check current state: %v", err)
+		case applied:
+			step.Note = "already applied, will be kept on exit"
+			priorApplied[action.Name] = true
+		}
+
+		plan.Enable = append(plan.Enable, step)
+	}
+
+	plan.Enable = appendScriptStep(plan.Enable, SCRIPT_IN)
+
+	// Enabled bastion mode is disabled using actions recorded in marker
+	if marker != nil {
+		actions = getMarkerActions(marker)
+		priorApplied = make(map[string]bool)
+
+		for _, info := range marker.Actions {
+			priorApplied[info.Name] = info.PriorApplied
+		}
+	}
+
+	plan.Disable = appendScriptStep(plan.Disable, SCRIPT_OUT)
+
+	for _, action := range getRevertOrder(actions) {
+		step := &PlanStep{Name: action.Name, Desc: describeAction(action.Name, true)}
+
+		switch {
+		case priorApplied[action.Name]:
+			step.Note = "was applied before bastion mode, reverting will be skipped"
+		case action.Name == ACTION_ENABLE_BASTION:
+			step.Note = "will be skipped if any previous step fails"
+		}
+
+		plan.Disable = append(plan.Disable, step)
+	}
+
+	plan.Disable = append(plan.Disable, &PlanStep{
+		STEP_MARKER, "Remove bastion marker " + getStatePath(MARKER_FILE),
+		"will be skipped if any previous step fails",
+	})
+	plan.Disable = appendScriptStep(plan.Disable, SCRIPT_END)
+
+	return plan, nil
+}
+
+// printPlan prints plan to console
+func printPlan(plan *Plan) {
+	fmtc.Printf("Profile: {c}%s{!}\n", plan.Profile)
+	fmtc.Printf("Init system: {c}%s{!}\n", plan.InitSystem)
+
+	if plan.Active {
+		fmtc.Println("{y}Bastion mode is enabled now{!}")
+	}
+
+	fmtc.Println("\n{*}Enable:{!}")
+	printPlanSteps(plan.Enable)
+
+	fmtc.Println("\n{*}Disable:{!}")
+	printPlanSteps(plan.Disable)
+}
+
+// printPlanSteps prints list of plan steps to console
+func printPlanSteps(steps []*PlanStep) {
+	for i, step := range steps {
+		fmtc.Printf("  %2d. {*}%s{!}: %s\n", i+1, step.Name, step.Desc)
+
+		if step.Note != "" {
+			fmtc.Printf("      {s}%s{!}\n", step.Note)
+		}
+	}
+}
+
+// logPlan writes plan for given profile to log
+func logPlan(profile string) {
+	plan, err := buildPlan(profile)
+
+	if err != nil {
+		log.Error("Can't build plan: %v", err)
+		return
+	}
+
+	log.Info("Plan for %s profile (init system: %s):", plan.Profile, plan.InitSystem)
+
+	for i, step := range plan.Enable {
+		log.Info("Plan: enable step %d: %s: %s %s", i+1, step.Name, step.Desc, formatPlanNote(step.Note))
+	}
+
+	for i, step := range plan.Disable {
+		log.Info("Plan: disable step %d: %s: %s %s", i+1, step.Name, step.Desc, formatPlanNote(step.Note))
+	}
+}
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// describeAction returns human-readable description of action
+func describeAction(name string, revert bool) string {
+	switch name {
+	case ACTION_DISABLE_SSHD:
+		return pickDesc(revert, "Disable sshd service autostart", "Enable sshd service autostart")
+	case ACTION_STOP_SSHD:
+		return pickDesc(revert, "Stop sshd service", "Start sshd service")
+	case ACTION_ENABLE_BASTION:
+		return pickDesc(revert, "Enable bastion service autostart", "Disable bastion service autostart")
+	case ACTION_RESTRICT_SSHD:
+		return pickDesc(revert,
+			"Write sshd configuration snippet "+getSSHDDropInPath()+" and reload sshd",
+			"Remove sshd configuration snippet "+getSSHDDropInPath()+" and reload sshd",
+		)
+	case ACTION_NOLOGIN:
+		return pickDesc(revert, "Create "+NOLOGIN_FILE, "Remove "+NOLOGIN_FILE)
+	case ACTION_FIREWALL:
+		bins := strings.Join(getFirewallBinaries(), ", ")
+		return pickDesc(revert,
+			fmt.Sprintf("Block incoming connections using %s chain (%s)", FIREWALL_CHAIN, bins),
+			fmt.Sprintf("Remove %s chain (%s)", FIREWALL_CHAIN, bins),
+		)
+	case ACTION_KILL_SESSIONS:
+		return pickDesc(revert, "Terminate active SSH sessions once (new sessions are not terminated)", "Nothing to revert")
+	case ACTION_LOCK_ACCOUNTS:
+		users := getLockUsers()
+
+		if len(users) == 0 {
+			return "No accounts configured"
+		}
+
+		return pickDesc(revert,
+			"Lock accounts "+strings.Join(users, ", "),
+			"Unlock accounts "+strings.Join(users, ", "),
+		)
+	}
+
+	return "Unknown action"
+}
+
+// pickDesc returns description of applying or reverting
+func pickDesc(revert bool, apply, rev string) string {
+	if revert {
+		return rev
+	}
+
+	return apply
+}
+
+// appendScriptStep appends step with script execution if script is configured
+func appendScriptStep(steps []*PlanStep, prop string) []*PlanStep {
+	if !knf.HasProp(prop) {
+		return steps
+	}
+
+	return append(steps, &PlanStep{"script", "Run " + knf.GetS(prop), ""})
+}
+
+// getPlanMarker returns current bastion marker without creating marker key
+func getPlanMarker() *BastionMarker {
+	if !isBastionMarkerExist() || !fsutil.IsExist(getStatePath(KEY_FILE)) {
+		return nil
+	}
+
+	marker, err := getBastionMarkerInfo()
+
+	if err != nil {
+		return nil
+	}
+
+	return marker
+}
+
+// getInitSystemName returns name of used init system
+func getInitSystemName() string {
+	switch {
+	case initsystem.Systemd():
+		return "systemd"
+	case initsystem.Upstart():
+		return "upstart"
+	}
+
+	return "sysv"
+}
+
+// formatPlanNote formats note for log record
+func formatPlanNote(note string) string {
+	if note == "" {
+		return ""
+	}
+
+	return "(" + note + ")"
+}
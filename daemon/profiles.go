@@ -0,0 +1,236 @@
+package daemon
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+//                                                                                    //
+//                         Copyright (c) 2022 ESSENTIAL KAOS                          //
+//      Apache License, Version 2.0 <https://www.apache.org/licenses/LICENSE-2.0>     //
+//                                                                                    //
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/essentialkaos/ek/v12/knf"
+)
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// PROFILES_SECTION is name of configuration section with lockdown profiles
+const PROFILES_SECTION = "profiles"
+
+// Built-in profiles
+const (
+	PROFILE_SOFT     = "soft"
+	PROFILE_STANDARD = "standard"
+	PROFILE_HARD     = "hard"
+)
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// Profile is named list of lockdown actions
+type Profile struct {
+	Name    string
+	Actions []string
+}
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// builtinProfiles is list of built-in profiles
+var builtinProfiles = []*Profile{
+	{PROFILE_SOFT, []string{ACTION_NOLOGIN, ACTION_RESTRICT_SSHD, ACTION_ENABLE_BASTION}},
+	{PROFILE_STANDARD, []string{ACTION_DISABLE_SSHD, ACTION_STOP_SSHD, ACTION_ENABLE_BASTION}},
+	{PROFILE_HARD, []string{
+		ACTION_FIREWALL, ACTION_DISABLE_SSHD, ACTION_STOP_SSHD,
+		ACTION_KILL_SESSIONS, ACTION_LOCK_ACCOUNTS, ACTION_ENABLE_BASTION,
+	}},
+}
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// HasAction returns true if profile contains action with given name
+func (p *Profile) HasAction(name string) bool {
+	for _, action := range p.Actions {
+		if action == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// getProfiles returns list of profiles, custom profiles are placed after
+// built-in profiles
+func getProfiles() []*Profile {
+	var result []*Profile
+
+	for _, p := range builtinProfiles {
+		result = append(result, &Profile{p.Name, p.Actions})
+	}
+
+	for _, name := range knf.Props(PROFILES_SECTION) {
+		actions := strings.FieldsFunc(knf.GetS(PROFILES_SECTION+":"+name), isListSeparator)
+		profile := findProfile(result, name)
+
+		if profile != nil {
+			profile.Actions = actions
+		} else {
+			result = append(result, &Profile{name, actions})
+		}
+	}
+
+	return result
+}
+
+// getProfile returns profile with given name or default profile if name is empty
+func getProfile(name string) (*Profile, error) {
+	if name == "" {
+		name = getDefaultProfileName()
+	}
+
+	profile := findProfile(getProfiles(), name)
+
+	if profile == nil {
+		return nil, fmt.Errorf("Unknown profile \"%s\"", name)
+	}
+
+	return profile, nil
+}
+
+// isHarderProfile returns true if profile contains actions which are not
+// applied by enabled bastion mode, actions of current profile are never
+// reverted on escalation, so such profile always makes lockdown harder
+func isHarderProfile(profile *Profile, marker *BastionMarker) bool {
+	applied := make(map[string]bool)
+
+	for _, action := range getMarkerActions(marker) {
+		applied[action.Name] = true
+	}
+
+	for _, action := range profile.Actions {
+		if !applied[action] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// getDefaultProfileName returns name of default profile
+func getDefaultProfileName() string {
+	return pickDefaultProfile(knf.GetS(MAIN_PROFILE), knf.GetS(MAIN_LEVEL))
+}
+
+// pickDefaultProfile returns name of default profile using values of profile
+// and level properties
+func pickDefaultProfile(profile, level string) string {
+	if profile != "" {
+		return profile
+	}
+
+	// Lockdown level is supported for compatibility with older configs
+	if level == LEVEL_RESTRICTED {
+		return PROFILE_SOFT
+	}
+
+	return PROFILE_STANDARD
+}
+
+// getProfileActions returns ordered list of actions of profile with given name
+func getProfileActions(name string) ([]*Action, error) {
+	profile, err := getProfile(name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var result []*Action
+
+	for _, actionName := range profile.Actions {
+		action := getKnownAction(actionName)
+
+		if action == nil {
+			return nil, fmt.Errorf("Profile \"%s\" contains unknown action \"%s\"", profile.Name, actionName)
+		}
+
+		result = append(result, action)
+	}
+
+	return result, nil
+}
+
+// findConfigProfile returns profile with given name (or default profile if
+// name is empty) defined in given configuration
+func findConfigProfile(config *knf.Config, name string) *Profile {
+	if name == "" {
+		name = pickDefaultProfile(config.GetS(MAIN_PROFILE), config.GetS(MAIN_LEVEL))
+	}
+
+	if config.HasProp(PROFILES_SECTION + ":" + name) {
+		return &Profile{
+			name, strings.FieldsFunc(config.GetS(PROFILES_SECTION+":"+name), isListSeparator),
+		}
+	}
+
+	return findProfile(builtinProfiles, name)
+}
+
+// findProfile returns profile with given name from list
+func findProfile(profiles []*Profile, name string) *Profile {
+	for _, profile := range profiles {
+		if profile.Name == name {
+			return profile
+		}
+	}
+
+	return nil
+}
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// validateProfile is knf validator for profile name
+func validateProfile(config *knf.Config, prop string, value interface{}) error {
+	if config.GetS(prop) == "" {
+		return nil
+	}
+
+	// Actions of custom profiles are checked by profile validators
+	if findConfigProfile(config, config.GetS(prop)) == nil {
+		return fmt.Errorf("Property %s contains unknown profile \"%s\"", prop, config.GetS(prop))
+	}
+
+	return nil
+}
+
+// getProfileValidators returns validators for all custom profiles
+func getProfileValidators(props func(section string) []string) []*knf.Validator {
+	var validators []*knf.Validator
+
+	for _, name := range props(PROFILES_SECTION) {
+		validators = append(validators, &knf.Validator{
+			Property: PROFILES_SECTION + ":" + name,
+			Func:     validateProfileActions,
+		})
+	}
+
+	return validators
+}
+
+// validateProfileActions is knf validator for list of profile actions
+func validateProfileActions(config *knf.Config, prop string, value interface{}) error {
+	actions := strings.FieldsFunc(config.GetS(prop), isListSeparator)
+
+	if len(actions) == 0 {
+		return fmt.Errorf("Profile %s doesn't contain any action", prop)
+	}
+
+	for _, action := range actions {
+		if getKnownAction(action) == nil {
+			return fmt.Errorf("Profile %s contains unknown action \"%s\"", prop, action)
+		}
+	}
+
+	return nil
+}
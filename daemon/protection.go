@@ -0,0 +1,205 @@
+package daemon
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+//                                                                                    //
+//                         Copyright (c) 2022 ESSENTIAL KAOS                          //
+//      Apache License, Version 2.0 <https://www.apache.org/licenses/LICENSE-2.0>     //
+//                                                                                    //
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+import (
+	"sync"
+	"time"
+
+	"github.com/essentialkaos/ek/v12/knf"
+	"github.com/essentialkaos/ek/v12/log"
+)
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// MAX_TRACKED_CLIENTS is maximum number of clients after which stale records
+// will be removed
+const MAX_TRACKED_CLIENTS = 10000
+
+// GUARD_CLEANUP_INTERVAL is interval between removals of stale records
+const GUARD_CLEANUP_INTERVAL = time.Minute
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// clientInfo contains info about requests from one IP
+type clientInfo struct {
+	WindowStart int64
+	Requests    int
+	FailsStart  int64
+	Fails       int
+	BannedUntil int64
+}
+
+// guard tracks requests from clients
+type guard struct {
+	clients map[string]*clientInfo
+	bans    []int64 // Times of bans
+	mx      sync.Mutex
+}
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+var requestGuard = &guard{clients: make(map[string]*clientInfo)}
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// startRequestGuard starts periodical removal of stale records
+func startRequestGuard() {
+	go func() {
+		ticker := time.NewTicker(GUARD_CLEANUP_INTERVAL)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			requestGuard.mx.Lock()
+			requestGuard.cleanup(time.Now().Unix())
+			requestGuard.mx.Unlock()
+		}
+	}()
+}
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// checkClient checks if client is allowed to make request
+func (g *guard) checkClient(ip string) (bool, string) {
+	g.mx.Lock()
+	defer g.mx.Unlock()
+
+	now := time.Now().Unix()
+	client := g.getClient(ip, now)
+
+	if client.BannedUntil > now {
+		return false, "banned"
+	}
+
+	if now-client.WindowStart >= 60 {
+		client.WindowStart, client.Requests = now, 0
+	}
+
+	client.Requests++
+
+	rate := knf.GetI(PROTECTION_RATE, 60)
+
+	if rate > 0 && client.Requests > rate {
+		return false, "rate limit exceeded"
+	}
+
+	return true, ""
+}
+
+// registerFail registers failed request (e.g. request with wrong path) and
+// returns true if the number of bans reached the limit for lockdown
+func (g *guard) registerFail(ip, reason string) bool {
+	g.mx.Lock()
+	defer g.mx.Unlock()
+
+	now := time.Now().Unix()
+	client := g.getClient(ip, now)
+	maxFails := knf.GetI(PROTECTION_MAX_FAILS, 10)
+
+	// Fails made before window aren't counted
+	if now-client.FailsStart >= getFailsWindow() {
+		client.FailsStart, client.Fails = now, 0
+	}
+
+	client.Fails++
+
+	log.Warn(
+		"%s from %s (%d/%d)",
+		reason, ip, client.Fails, maxFails,
+	)
+
+	if maxFails <= 0 || client.Fails < maxFails {
+		return false
+	}
+
+	banTime := knf.GetI64(PROTECTION_BAN_TIME, 3600)
+
+	client.Fails = 0
+	client.BannedUntil = now + banTime
+	g.bans = append(g.pruneBans(now), now)
+
+	logEvent(
+		EVENT_LEVEL_WARN,
+		&Event{Event: EVENT_CLIENT_BANNED, Actor: ip, Duration: banTime},
+		"[SUSPICIOUS] Client %s is banned for %d seconds due to probing",
+		ip, banTime,
+	)
+
+	if !knf.GetB(PROTECTION_LOCKDOWN) {
+		return false
+	}
+
+	lockdownBans := knf.GetI(PROTECTION_LOCKDOWN_BANS, 1)
+
+	if lockdownBans < 1 {
+		lockdownBans = 1
+	}
+
+	return len(g.bans) >= lockdownBans
+}
+
+// getClient returns info about client with given IP
+func (g *guard) getClient(ip string, now int64) *clientInfo {
+	client := g.clients[ip]
+
+	if client != nil {
+		return client
+	}
+
+	if len(g.clients) >= MAX_TRACKED_CLIENTS {
+		g.cleanup(now)
+	}
+
+	client = &clientInfo{WindowStart: now, FailsStart: now}
+	g.clients[ip] = client
+
+	return client
+}
+
+// cleanup removes records without active bans, recent requests and fails, and
+// bans older than lockdown window
+func (g *guard) cleanup(now int64) {
+	failsWindow := getFailsWindow()
+
+	for ip, client := range g.clients {
+		if client.BannedUntil < now && now-client.WindowStart >= 60 &&
+			(client.Fails == 0 || now-client.FailsStart >= failsWindow) {
+			delete(g.clients, ip)
+		}
+	}
+
+	g.bans = g.pruneBans(now)
+}
+
+// pruneBans returns times of bans made in lockdown window
+func (g *guard) pruneBans(now int64) []int64 {
+	window := knf.GetI64(PROTECTION_LOCKDOWN_WINDOW, 3600)
+
+	if window <= 0 {
+		window = 3600
+	}
+
+	for len(g.bans) != 0 && now-g.bans[0] >= window {
+		g.bans = g.bans[1:]
+	}
+
+	return g.bans
+}
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// getFailsWindow returns window in seconds for counting fails
+func getFailsWindow() int64 {
+	window := knf.GetI64(PROTECTION_FAILS_WINDOW, 600)
+
+	if window <= 0 {
+		return 600
+	}
+
+	return window
+}
@@ -0,0 +1,267 @@
+package daemon
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+//                                                                                    //
+//                         Copyright (c) 2022 ESSENTIAL KAOS                          //
+//      Apache License, Version 2.0 <https://www.apache.org/licenses/LICENSE-2.0>     //
+//                                                                                    //
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/essentialkaos/ek/v12/fsutil"
+	"github.com/essentialkaos/ek/v12/jsonutil"
+	"github.com/essentialkaos/ek/v12/knf"
+
+	"github.com/valyala/fasthttp"
+)
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// RECOVERY_CODES_COUNT is number of generated recovery codes
+const RECOVERY_CODES_COUNT = 10
+
+// RECOVERY_CODE_SIZE is size of recovery code in bytes
+const RECOVERY_CODE_SIZE = 10
+
+// RECOVERY_TIMEOUT is timeout for recovery request to running daemon
+const RECOVERY_TIMEOUT = 30 * time.Second
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// RecoveryCodes contains hashes of single-use recovery codes
+type RecoveryCodes struct {
+	Salt    string          `json:"salt"`
+	Created int64           `json:"created"`
+	Codes   []*RecoveryCode `json:"codes"`
+}
+
+// RecoveryCode contains hash of recovery code and info about its usage
+type RecoveryCode struct {
+	Hash    string `json:"hash"`
+	Spent   int64  `json:"spent,omitempty"`
+	SpentBy string `json:"spent_by,omitempty"`
+}
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+var (
+	ErrRecoveryCodeInvalid = errors.New("Recovery code is invalid")
+	ErrRecoveryCodeSpent   = errors.New("Recovery code is already spent")
+	ErrNoRecoveryCodes     = errors.New("Recovery codes are not generated")
+)
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// recoveryMx guards recovery codes file
+var recoveryMx sync.Mutex
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// generateRecoveryCodes generates new set of recovery codes and saves their
+// hashes to state file
+func generateRecoveryCodes() ([]string, error) {
+	recoveryMx.Lock()
+	defer recoveryMx.Unlock()
+
+	salt, err := genSalt()
+
+	if err != nil {
+		return nil, err
+	}
+
+	var result []string
+
+	codes := &RecoveryCodes{Salt: salt, Created: time.Now().Unix()}
+
+	for i := 0; i < RECOVERY_CODES_COUNT; i++ {
+		buf := make([]byte, RECOVERY_CODE_SIZE)
+		_, err = rand.Read(buf)
+
+		if err != nil {
+			return nil, fmt.Errorf("Can't generate recovery code: %v", err)
+		}
+
+		code := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(buf)
+
+		codes.Codes = append(codes.Codes, &RecoveryCode{Hash: hashKey(salt, code)})
+		result = append(result, formatRecoveryCode(code))
+	}
+
+	err = writeJSONAtomic(getStatePath(RECOVERY_FILE), codes)
+
+	if err != nil {
+		return nil, fmt.Errorf("Can't save recovery codes: %v", err)
+	}
+
+	return result, nil
+}
+
+// checkRecoveryCode checks recovery code without spending it, returns number
+// of code
+func checkRecoveryCode(code string) (int, error) {
+	recoveryMx.Lock()
+	defer recoveryMx.Unlock()
+
+	codes, err := readRecoveryCodes()
+
+	if err != nil {
+		return -1, err
+	}
+
+	return findRecoveryCode(codes, code)
+}
+
+// spendRecoveryCode marks recovery code as spent, code must be spent only
+// after bastion mode disabling is started, so code isn't lost if it fails
+func spendRecoveryCode(code, actor string) error {
+	recoveryMx.Lock()
+	defer recoveryMx.Unlock()
+
+	codes, err := readRecoveryCodes()
+
+	if err != nil {
+		return err
+	}
+
+	num, err := findRecoveryCode(codes, code)
+
+	if err != nil {
+		return err
+	}
+
+	c := codes.Codes[num-1]
+	c.Spent, c.SpentBy = time.Now().Unix(), actor
+
+	err = writeJSONAtomic(getStatePath(RECOVERY_FILE), codes)
+
+	if err != nil {
+		return fmt.Errorf("Can't mark recovery code as spent: %v", err)
+	}
+
+	return nil
+}
+
+// findRecoveryCode returns number of unspent recovery code
+func findRecoveryCode(codes *RecoveryCodes, code string) (int, error) {
+	hash := hashKey(codes.Salt, normalizeRecoveryCode(code))
+
+	for i, c := range codes.Codes {
+		if subtle.ConstantTimeCompare([]byte(hash), []byte(c.Hash)) != 1 {
+			continue
+		}
+
+		if c.Spent != 0 {
+			return i + 1, ErrRecoveryCodeSpent
+		}
+
+		return i + 1, nil
+	}
+
+	return -1, ErrRecoveryCodeInvalid
+}
+
+// sendRecoveryRequest sends recovery code to running daemon
+func sendRecoveryRequest(code string) error {
+	ip := knf.GetS(SERVER_IP)
+
+	if ip == "" || ip == "0.0.0.0" {
+		ip = "127.0.0.1"
+	}
+
+	req := fasthttp.AcquireRequest()
+	resp := fasthttp.AcquireResponse()
+
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(resp)
+
+	args := fasthttp.AcquireArgs()
+	args.Set("code", code)
+
+	defer fasthttp.ReleaseArgs(args)
+
+	req.SetRequestURI("http://" + ip + ":" + knf.GetS(SERVER_PORT) + "/recover")
+	req.Header.SetMethod(fasthttp.MethodPost)
+	req.Header.SetContentType("application/x-www-form-urlencoded")
+	req.SetBody(args.QueryString())
+
+	err := fasthttp.DoTimeout(req, resp, RECOVERY_TIMEOUT)
+
+	if err != nil {
+		return fmt.Errorf("Can't send recovery request to daemon: %v", err)
+	}
+
+	switch resp.StatusCode() {
+	case 200:
+		return nil
+	case 409:
+		return ErrNotActive
+	case 403:
+		return ErrRecoveryCodeInvalid
+	}
+
+	return fmt.Errorf("Daemon returned unexpected status code %d", resp.StatusCode())
+}
+
+// getUnspentRecoveryCodesNum returns number of unspent recovery codes
+func getUnspentRecoveryCodesNum() int {
+	codes, err := readRecoveryCodes()
+
+	if err != nil {
+		return 0
+	}
+
+	var result int
+
+	for _, c := range codes.Codes {
+		if c.Spent == 0 {
+			result++
+		}
+	}
+
+	return result
+}
+
+// readRecoveryCodes reads recovery codes from state file
+func readRecoveryCodes() (*RecoveryCodes, error) {
+	file := getStatePath(RECOVERY_FILE)
+
+	if !fsutil.IsExist(file) {
+		return nil, ErrNoRecoveryCodes
+	}
+
+	codes := &RecoveryCodes{}
+	err := jsonutil.Read(file, codes)
+
+	if err != nil {
+		return nil, fmt.Errorf("Can't read recovery codes: %v", err)
+	}
+
+	return codes, nil
+}
+
+// normalizeRecoveryCode removes separators from recovery code
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToUpper(code)
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
+
+// formatRecoveryCode splits recovery code to groups for better readability
+func formatRecoveryCode(code string) string {
+	var groups []string
+
+	for len(code) > 4 {
+		groups = append(groups, code[:4])
+		code = code[4:]
+	}
+
+	return strings.Join(append(groups, code), "-")
+}
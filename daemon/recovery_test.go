@@ -0,0 +1,121 @@
+package daemon
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+//                                                                                    //
+//                         Copyright (c) 2022 ESSENTIAL KAOS                          //
+//      Apache License, Version 2.0 <https://www.apache.org/licenses/LICENSE-2.0>     //
+//                                                                                    //
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+import (
+	"strings"
+	"testing"
+)
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+func TestSpendRecoveryCode(t *testing.T) {
+	defer func(dir string) { stateDir = dir }(stateDir)
+
+	stateDir = t.TempDir()
+
+	codes, err := generateRecoveryCodes()
+
+	if err != nil {
+		t.Fatalf("Can't generate recovery codes: %v", err)
+	}
+
+	if len(codes) != RECOVERY_CODES_COUNT {
+		t.Fatalf("Unexpected number of codes %d", len(codes))
+	}
+
+	// Tests are ordered, spent codes can't be used again
+	tests := []struct {
+		name  string
+		code  string
+		num   int
+		err   error
+		spend bool
+	}{
+		{"formatted", codes[0], 1, nil, true},
+		{"spent", codes[0], 1, ErrRecoveryCodeSpent, false},
+		{"checked", codes[1], 2, nil, false},
+		{"unspent after check", strings.ToLower(codes[1]), 2, nil, true},
+		{"without separators", strings.ReplaceAll(codes[2], "-", ""), 3, nil, true},
+		{"spaces instead of dashes", strings.ReplaceAll(codes[3], "-", " "), 4, nil, true},
+		{"last", codes[RECOVERY_CODES_COUNT-1], RECOVERY_CODES_COUNT, nil, true},
+		{"truncated", codes[4][:len(codes[4])-1], -1, ErrRecoveryCodeInvalid, false},
+		{"extra symbol", codes[4] + "A", -1, ErrRecoveryCodeInvalid, false},
+		{"empty", "", -1, ErrRecoveryCodeInvalid, false},
+		{"unspent after failures", codes[4], 5, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			num, err := checkRecoveryCode(tt.code)
+
+			if err != tt.err {
+				t.Fatalf("Unexpected error %v, expected %v", err, tt.err)
+			}
+
+			if num != tt.num {
+				t.Fatalf("Unexpected code number %d, expected %d", num, tt.num)
+			}
+
+			if !tt.spend {
+				return
+			}
+
+			err = spendRecoveryCode(tt.code, "test")
+
+			if err != nil {
+				t.Fatalf("Can't spend recovery code: %v", err)
+			}
+		})
+	}
+
+	if spendRecoveryCode(codes[0], "test") != ErrRecoveryCodeSpent {
+		t.Fatal("Spent code must not be spent again")
+	}
+
+	if getUnspentRecoveryCodesNum() != RECOVERY_CODES_COUNT-6 {
+		t.Fatalf("Unexpected number of unspent codes %d", getUnspentRecoveryCodesNum())
+	}
+}
+
+func TestCheckRecoveryCodeWithoutCodes(t *testing.T) {
+	defer func(dir string) { stateDir = dir }(stateDir)
+
+	stateDir = t.TempDir()
+
+	_, err := checkRecoveryCode("AAAA-AAAA-AAAA-AAAA")
+
+	if err != ErrNoRecoveryCodes {
+		t.Fatalf("Unexpected error %v", err)
+	}
+}
+
+func TestFormatRecoveryCode(t *testing.T) {
+	tests := []struct {
+		code   string
+		result string
+	}{
+		{"", ""},
+		{"ABCD", "ABCD"},
+		{"ABCDE", "ABCD-E"},
+		{"ABCDEFGH", "ABCD-EFGH"},
+		{"ABCDEFGHIJKLMNOP", "ABCD-EFGH-IJKL-MNOP"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.code, func(t *testing.T) {
+			if formatRecoveryCode(tt.code) != tt.result {
+				t.Fatalf("Unexpected result %q, expected %q", formatRecoveryCode(tt.code), tt.result)
+			}
+
+			if normalizeRecoveryCode(strings.ToLower(tt.result)) != tt.code {
+				t.Fatalf("Normalized code %q doesn't match %q", normalizeRecoveryCode(tt.result), tt.code)
+			}
+		})
+	}
+}
@@ -0,0 +1,253 @@
+package daemon
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+//                                                                                    //
+//                         Copyright (c) 2022 ESSENTIAL KAOS                          //
+//      Apache License, Version 2.0 <https://www.apache.org/licenses/LICENSE-2.0>     //
+//                                                                                    //
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+import (
+	"os"
+	"sort"
+
+	"github.com/essentialkaos/ek/v12/knf"
+	"github.com/essentialkaos/ek/v12/log"
+	"github.com/essentialkaos/ek/v12/options"
+)
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// configSource is source of configuration values
+type configSource interface {
+	Sections() []string
+	Props(section string) []string
+	GetS(name string, defvals ...string) string
+}
+
+// globalConfig is configuration source for global configuration
+type globalConfig struct{}
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// restartProps is list of properties which are applied only on daemon start
+var restartProps = []string{
+	MAIN_STATE_DIR, MAIN_PID_DIR,
+	SERVER_IP, SERVER_PORT, SERVER_NAME, SERVER_PROXY_PROTOCOL,
+	AUTHLOG_ENABLED, AUTHLOG_SOURCE, AUTHLOG_ROOT_FAILS, AUTHLOG_ROOT_FAILS_WINDOW,
+	AUTHLOG_FAILS, AUTHLOG_FAILS_WINDOW,
+	CANARY_PATHS,
+	DEADMAN_ENABLED,
+	LOG_DIR, LOG_FILE, LOG_PERMS, LOG_FORMAT, LOG_AUDIT, LOG_EVENTS,
+}
+
+// secretProps is list of properties which values must not be logged
+var secretProps = []string{TRIGGER_CONFIRM, DEADMAN_KEY}
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// Sections returns list of sections of global configuration
+func (globalConfig) Sections() []string {
+	return knf.Sections()
+}
+
+// Props returns list of properties in section of global configuration
+func (globalConfig) Props(section string) []string {
+	return knf.Props(section)
+}
+
+// GetS returns property value from global configuration
+func (globalConfig) GetS(name string, defvals ...string) string {
+	return knf.GetS(name, defvals...)
+}
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// reloadConfig re-reads configuration file and applies it if it valid,
+// otherwise current configuration is kept
+func reloadConfig() {
+	log.Info("Reloading configuration...")
+
+	file, sources, err := buildConfigFile(options.GetS(OPT_CONFIG))
+
+	if err != nil {
+		log.Error("Can't read configuration, current configuration is kept: %v", err)
+		return
+	}
+
+	defer os.Remove(file)
+
+	config, err := knf.Read(file)
+
+	if err != nil {
+		log.Error("Can't read configuration, current configuration is kept: %v", err)
+		return
+	}
+
+	errs := config.Validate(getConfigValidators(config.Props))
+
+	if len(errs) != 0 {
+		log.Error("New configuration is invalid, current configuration is kept:")
+
+		for _, err := range errs {
+			log.Error("  %v", err)
+		}
+
+		return
+	}
+
+	diff := diffConfigs(getConfigValues(globalConfig{}), getConfigValues(config))
+
+	if len(diff) == 0 {
+		log.Info("Configuration is not changed")
+		return
+	}
+
+	// Global configuration is not replaced with knf.Global, because pointer to
+	// it is swapped without synchronization. knf.Reload re-reads file of global
+	// configuration and replaces its data under configuration lock, which is
+	// also used by all knf getters, so readers see either old or new
+	// configuration.
+	err = os.Rename(file, configFile)
+
+	if err != nil {
+		log.Error("Can't reload configuration: %v", err)
+		return
+	}
+
+	_, err = knf.Reload()
+	os.Remove(configFile)
+
+	if err != nil {
+		log.Error("Can't reload configuration: %v", err)
+		return
+	}
+
+	configSources = sources
+
+	for _, line := range diff {
+		log.Info("Configuration changed: %s", line)
+	}
+
+	applyConfig()
+
+	logEvent(
+		EVENT_LEVEL_INFO,
+		&Event{Event: EVENT_CONFIG_RELOADED, Source: "signal", Actor: "HUP"},
+		"Configuration reloaded (%d changes)", len(diff),
+	)
+}
+
+// applyConfig applies settings which are cached by daemon
+func applyConfig() {
+	err := log.MinLevel(knf.GetS(LOG_LEVEL))
+
+	if err != nil {
+		log.Error("Can't set log level: %v", err)
+	}
+
+	err = configureNetwork()
+
+	if err != nil {
+		log.Error(err.Error())
+	}
+
+	// Windows can be added to configuration without any windows on start
+	startScheduler()
+}
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// getConfigValues returns map with all properties and their values
+func getConfigValues(config configSource) map[string]string {
+	result := make(map[string]string)
+
+	for _, section := range config.Sections() {
+		for _, prop := range config.Props(section) {
+			result[section+":"+prop] = config.GetS(section + ":" + prop)
+		}
+	}
+
+	return result
+}
+
+// diffConfigs returns sorted list of changes between two configurations
+func diffConfigs(old, new map[string]string) []string {
+	var result []string
+
+	for prop, value := range new {
+		oldValue, ok := old[prop]
+
+		switch {
+		case !ok:
+			result = append(result, formatConfigChange(prop, "added", "", value))
+		case oldValue != value:
+			result = append(result, formatConfigChange(prop, "changed", oldValue, value))
+		}
+	}
+
+	for prop, value := range old {
+		if _, ok := new[prop]; !ok {
+			result = append(result, formatConfigChange(prop, "removed", value, ""))
+		}
+	}
+
+	sort.Strings(result)
+
+	return result
+}
+
+// formatConfigChange formats info about property change
+func formatConfigChange(prop, kind, oldValue, newValue string) string {
+	if isSecretProp(prop) {
+		oldValue, newValue = maskSecret(oldValue), maskSecret(newValue)
+	}
+
+	result := prop + " " + kind
+
+	switch kind {
+	case "added":
+		result += " (\"" + newValue + "\")"
+	case "removed":
+		result += " (was \"" + oldValue + "\")"
+	default:
+		result += " (\"" + oldValue + "\" -> \"" + newValue + "\")"
+	}
+
+	if isRestartProp(prop) {
+		result += ", restart is required to apply it"
+	}
+
+	return result
+}
+
+// maskSecret hides secret value
+func maskSecret(value string) string {
+	if value == "" {
+		return ""
+	}
+
+	return "*****"
+}
+
+// isRestartProp returns true if property is applied only on daemon start
+func isRestartProp(prop string) bool {
+	for _, p := range restartProps {
+		if p == prop {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isSecretProp returns true if property value must not be logged
+func isSecretProp(prop string) bool {
+	for _, p := range secretProps {
+		if p == prop {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,106 @@
+package daemon
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+//                                                                                    //
+//                         Copyright (c) 2022 ESSENTIAL KAOS                          //
+//      Apache License, Version 2.0 <https://www.apache.org/licenses/LICENSE-2.0>     //
+//                                                                                    //
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+import (
+	"strings"
+	"testing"
+)
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+func TestDiffConfigs(t *testing.T) {
+	tests := []struct {
+		name string
+		old  map[string]string
+		new  map[string]string
+		diff []string
+	}{
+		{"empty", nil, nil, nil},
+		{
+			"not changed",
+			map[string]string{MAIN_DURATION: "3600"},
+			map[string]string{MAIN_DURATION: "3600"},
+			nil,
+		},
+		{
+			"added",
+			map[string]string{},
+			map[string]string{MAIN_DURATION: "3600"},
+			[]string{`main:duration added ("3600")`},
+		},
+		{
+			"removed",
+			map[string]string{MAIN_DURATION: "3600"},
+			map[string]string{},
+			[]string{`main:duration removed (was "3600")`},
+		},
+		{
+			"changed",
+			map[string]string{MAIN_DURATION: "3600"},
+			map[string]string{MAIN_DURATION: "7200"},
+			[]string{`main:duration changed ("3600" -> "7200")`},
+		},
+		{
+			"empty value",
+			map[string]string{SERVER_ALLOW: "10.0.0.0/8"},
+			map[string]string{SERVER_ALLOW: ""},
+			[]string{`server:allow changed ("10.0.0.0/8" -> "")`},
+		},
+		{
+			"restart property",
+			map[string]string{SERVER_PORT: "17491"},
+			map[string]string{SERVER_PORT: "17492"},
+			[]string{`server:port changed ("17491" -> "17492"), restart is required to apply it`},
+		},
+		{
+			"secret property",
+			map[string]string{DEADMAN_KEY: "old-secret"},
+			map[string]string{DEADMAN_KEY: "new-secret"},
+			[]string{`deadman:key changed ("*****" -> "*****")`},
+		},
+		{
+			"secret property added",
+			map[string]string{},
+			map[string]string{TRIGGER_CONFIRM: "secret"},
+			[]string{`trigger:confirm added ("*****")`},
+		},
+		{
+			"secret property cleared",
+			map[string]string{TRIGGER_CONFIRM: "secret"},
+			map[string]string{TRIGGER_CONFIRM: ""},
+			[]string{`trigger:confirm changed ("*****" -> "")`},
+		},
+		{
+			"sorted",
+			map[string]string{SERVER_ALLOW: "", MAIN_DURATION: "3600"},
+			map[string]string{MAIN_DURATION: "7200", LOG_LEVEL: "debug"},
+			[]string{
+				`log:level added ("debug")`,
+				`main:duration changed ("3600" -> "7200")`,
+				`server:allow removed (was "")`,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			diff := diffConfigs(tt.old, tt.new)
+
+			if strings.Join(diff, "\n") != strings.Join(tt.diff, "\n") {
+				t.Fatalf("Unexpected diff:\n%s\nexpected:\n%s", strings.Join(diff, "\n"), strings.Join(tt.diff, "\n"))
+			}
+
+			for _, line := range diff {
+				if strings.Contains(line, "secret") {
+					t.Fatalf("Diff contains secret value: %s", line)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,442 @@
+package daemon
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+//                                                                                    //
+//                         Copyright (c) 2022 ESSENTIAL KAOS                          //
+//      Apache License, Version 2.0 <https://www.apache.org/licenses/LICENSE-2.0>     //
+//                                                                                    //
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/essentialkaos/ek/v12/fsutil"
+	"github.com/essentialkaos/ek/v12/jsonutil"
+	"github.com/essentialkaos/ek/v12/knf"
+	"github.com/essentialkaos/ek/v12/log"
+)
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// SCHEDULE_SECTION is name of configuration section with maintenance windows
+const SCHEDULE_SECTION = "schedule"
+
+// SCHEDULE_HORIZON is period for which upcoming windows are shown in status
+const SCHEDULE_HORIZON = 30 * 24 * time.Hour
+
+// EVERY_DAY is weekday value for windows which start every day
+const EVERY_DAY = -1
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// ScheduleWindow contains info about maintenance window
+type ScheduleWindow struct {
+	Start int64    `json:"start"`
+	End   int64    `json:"end"`
+	Names []string `json:"names"`
+}
+
+// scheduleRule is maintenance window rule from configuration
+type scheduleRule struct {
+	Name     string
+	IsWeekly bool
+
+	// Weekly windows
+	Weekday  int
+	Hour     int
+	Minute   int
+	Duration time.Duration
+
+	// Calendar windows
+	Start time.Time
+	End   time.Time
+}
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// weekdays contains supported names of weekdays
+var weekdays = map[string]int{
+	"day": EVERY_DAY,
+	"sun": 0, "sunday": 0,
+	"mon": 1, "monday": 1,
+	"tue": 2, "tuesday": 2,
+	"wed": 3, "wednesday": 3,
+	"thu": 4, "thursday": 4,
+	"fri": 5, "friday": 5,
+	"sat": 6, "saturday": 6,
+}
+
+// scheduler contains state of maintenance windows scheduler
+var scheduler struct {
+	mx      sync.Mutex
+	started bool
+}
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// startScheduler starts maintenance windows scheduler if any window configured,
+// scheduler reads windows from global configuration on every check, so it is
+// started only once
+func startScheduler() {
+	scheduler.mx.Lock()
+	defer scheduler.mx.Unlock()
+
+	if scheduler.started || len(knf.Props(SCHEDULE_SECTION)) == 0 {
+		return
+	}
+
+	scheduler.started = true
+
+	log.Info("Scheduler started (%d windows configured)", len(knf.Props(SCHEDULE_SECTION)))
+
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+
+		checkSchedule()
+
+		for range ticker.C {
+			checkSchedule()
+		}
+	}()
+}
+
+// checkSchedule enables bastion mode if maintenance window is started
+func checkSchedule() {
+	now := time.Now()
+	windows := getScheduleWindows(now, now.Add(time.Second))
+
+	if len(windows) == 0 || windows[0].Start > now.Unix() {
+		return
+	}
+
+	window := windows[0]
+
+	if isScheduleWindowHandled(window, now) {
+		return
+	}
+
+	state := ctrl.State()
+
+	if state != STATE_IDLE && state != STATE_ARMED {
+		log.Debug("Maintenance window is started, but bastion mode is %s", state)
+		return
+	}
+
+	log.Info(
+		"[IMPORTANT] Maintenance window %s is started, enabling bastion mode till %s...",
+		strings.Join(window.Names, "+"), formatTimestamp(window.End),
+	)
+
+	duration := window.End - now.Unix()
+
+	// Merged windows can be longer than maximum duration
+	if duration > MAX_DURATION {
+		log.Warn(
+			"Maintenance window %s is longer than maximum bastion mode duration, bastion mode will end at %s",
+			strings.Join(window.Names, "+"), formatTimestamp(now.Unix()+MAX_DURATION),
+		)
+		duration = MAX_DURATION
+	}
+
+	err := ctrl.ActivateFor(
+		&Trigger{
+			Source: "schedule",
+			Actor:  strings.Join(window.Names, "+"),
+			Reason: "Maintenance window",
+		},
+		duration,
+	)
+
+	// In dry-run mode window is marked as handled, so plan is logged only once
+	if err != nil && err != ErrDryRun {
+		log.Error("Can't enable bastion mode for maintenance window: %v", err)
+		return
+	}
+
+	err = writeJSONAtomic(getStatePath(SCHEDULE_FILE), window)
+
+	if err != nil {
+		log.Error("Can't save info about maintenance window: %v", err)
+	}
+}
+
+// isScheduleWindowHandled returns true if bastion mode was already enabled
+// for given window
+func isScheduleWindowHandled(window *ScheduleWindow, now time.Time) bool {
+	if !fsutil.IsExist(getStatePath(SCHEDULE_FILE)) {
+		return false
+	}
+
+	handled := &ScheduleWindow{}
+	err := jsonutil.Read(getStatePath(SCHEDULE_FILE), handled)
+
+	if err != nil {
+		return false
+	}
+
+	return handled.Start <= now.Unix() && handled.End > now.Unix()
+}
+
+// getUpcomingWindows returns current and upcoming maintenance windows
+func getUpcomingWindows() []*ScheduleWindow {
+	now := time.Now()
+	return getScheduleWindows(now, now.Add(SCHEDULE_HORIZON))
+}
+
+// getScheduleWindows returns merged maintenance windows overlapping with
+// given period
+func getScheduleWindows(from, to time.Time) []*ScheduleWindow {
+	var windows []*ScheduleWindow
+
+	for _, prop := range knf.Props(SCHEDULE_SECTION) {
+		rule, err := parseScheduleRule(prop, knf.GetS(SCHEDULE_SECTION+":"+prop))
+
+		if err != nil {
+			continue
+		}
+
+		windows = append(windows, rule.Windows(from, to)...)
+	}
+
+	return mergeWindows(windows)
+}
+
+// mergeWindows merges overlapping windows
+func mergeWindows(windows []*ScheduleWindow) []*ScheduleWindow {
+	if len(windows) == 0 {
+		return nil
+	}
+
+	sort.Slice(windows, func(i, j int) bool {
+		return windows[i].Start < windows[j].Start
+	})
+
+	result := []*ScheduleWindow{windows[0]}
+
+	for _, w := range windows[1:] {
+		last := result[len(result)-1]
+
+		if w.Start > last.End {
+			result = append(result, w)
+			continue
+		}
+
+		if w.End > last.End {
+			last.End = w.End
+		}
+
+		last.Names = appendUnique(last.Names, w.Names...)
+	}
+
+	return result
+}
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// Windows returns windows of rule overlapping with given period
+func (r *scheduleRule) Windows(from, to time.Time) []*ScheduleWindow {
+	if !r.IsWeekly {
+		if r.End.After(from) && r.Start.Before(to) {
+			return []*ScheduleWindow{{r.Start.Unix(), r.End.Unix(), []string{r.Name}}}
+		}
+
+		return nil
+	}
+
+	var result []*ScheduleWindow
+
+	day := from.Add(-r.Duration)
+	day = time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, time.Local)
+
+	for ; day.Before(to); day = day.AddDate(0, 0, 1) {
+		if r.Weekday != EVERY_DAY && int(day.Weekday()) != r.Weekday {
+			continue
+		}
+
+		start := time.Date(day.Year(), day.Month(), day.Day(), r.Hour, r.Minute, 0, 0, time.Local)
+		end := start.Add(r.Duration)
+
+		if end.After(from) && start.Before(to) {
+			result = append(result, &ScheduleWindow{start.Unix(), end.Unix(), []string{r.Name}})
+		}
+	}
+
+	return result
+}
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// parseScheduleRule parses weekly ("every fri 22:00 for 60h") or calendar
+// ("2026-12-24 to 2026-12-27") maintenance window rule
+func parseScheduleRule(name, value string) (*scheduleRule, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+
+	if strings.HasPrefix(value, "every ") {
+		return parseWeeklyRule(name, value)
+	}
+
+	return parseCalendarRule(name, value)
+}
+
+// parseWeeklyRule parses weekly maintenance window rule
+func parseWeeklyRule(name, value string) (*scheduleRule, error) {
+	fields := strings.Fields(value)
+
+	if len(fields) != 5 || fields[3] != "for" {
+		return nil, fmt.Errorf("Window \"%s\" must be in \"every <weekday> <HH:MM> for <duration>\" format", value)
+	}
+
+	weekday, ok := weekdays[fields[1]]
+
+	if !ok {
+		return nil, fmt.Errorf("Window \"%s\" contains unknown weekday \"%s\"", value, fields[1])
+	}
+
+	start, err := time.Parse("15:04", fields[2])
+
+	if err != nil {
+		return nil, fmt.Errorf("Window \"%s\" contains invalid time \"%s\"", value, fields[2])
+	}
+
+	duration, err := parseWindowDuration(fields[4])
+
+	if err != nil {
+		return nil, fmt.Errorf("Window \"%s\" contains invalid duration \"%s\"", value, fields[4])
+	}
+
+	if duration > MAX_DURATION*time.Second {
+		return nil, fmt.Errorf("Window \"%s\" is longer than maximum bastion mode duration (7d)", value)
+	}
+
+	return &scheduleRule{
+		Name:     name,
+		IsWeekly: true,
+		Weekday:  weekday,
+		Hour:     start.Hour(),
+		Minute:   start.Minute(),
+		Duration: duration,
+	}, nil
+}
+
+// parseCalendarRule parses calendar maintenance window rule
+func parseCalendarRule(name, value string) (*scheduleRule, error) {
+	dates := strings.Split(value, " to ")
+
+	if len(dates) != 2 {
+		return nil, fmt.Errorf("Window \"%s\" must be in \"<YYYY-MM-DD [HH:MM]> to <YYYY-MM-DD [HH:MM]>\" format", value)
+	}
+
+	start, _, err := parseWindowDate(dates[0])
+
+	if err != nil {
+		return nil, fmt.Errorf("Window \"%s\" contains invalid date \"%s\"", value, dates[0])
+	}
+
+	end, dateOnly, err := parseWindowDate(dates[1])
+
+	if err != nil {
+		return nil, fmt.Errorf("Window \"%s\" contains invalid date \"%s\"", value, dates[1])
+	}
+
+	if dateOnly {
+		// Window ends at the end of the day
+		end = end.AddDate(0, 0, 1)
+	}
+
+	if !end.After(start) {
+		return nil, fmt.Errorf("Window \"%s\" ends before start", value)
+	}
+
+	if end.Sub(start) > MAX_DURATION*time.Second {
+		return nil, fmt.Errorf("Window \"%s\" is longer than maximum bastion mode duration (7d)", value)
+	}
+
+	return &scheduleRule{Name: name, Start: start, End: end}, nil
+}
+
+// parseWindowDate parses date with optional time in local timezone
+func parseWindowDate(data string) (time.Time, bool, error) {
+	data = strings.TrimSpace(data)
+
+	t, err := time.ParseInLocation("2006-01-02 15:04", data, time.Local)
+
+	if err == nil {
+		return t, false, nil
+	}
+
+	t, err = time.ParseInLocation("2006-01-02", data, time.Local)
+
+	return t, true, err
+}
+
+// parseWindowDuration parses duration with support of days (d) and weeks (w)
+func parseWindowDuration(data string) (time.Duration, error) {
+	var unit time.Duration
+
+	switch {
+	case strings.HasSuffix(data, "d"):
+		unit = 24 * time.Hour
+	case strings.HasSuffix(data, "w"):
+		unit = 7 * 24 * time.Hour
+	default:
+		duration, err := time.ParseDuration(data)
+
+		if err == nil && duration <= 0 {
+			return 0, fmt.Errorf("Duration must be greater than zero")
+		}
+
+		return duration, err
+	}
+
+	num, err := strconv.Atoi(data[:len(data)-1])
+
+	if err != nil || num <= 0 {
+		return 0, fmt.Errorf("Invalid duration")
+	}
+
+	return time.Duration(num) * unit, nil
+}
+
+// appendUnique appends items which are not present in slice
+func appendUnique(slice []string, items ...string) []string {
+LOOP:
+	for _, item := range items {
+		for _, s := range slice {
+			if s == item {
+				continue LOOP
+			}
+		}
+
+		slice = append(slice, item)
+	}
+
+	return slice
+}
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// getScheduleValidators returns validators for all configured windows
+func getScheduleValidators(props func(section string) []string) []*knf.Validator {
+	var validators []*knf.Validator
+
+	for _, prop := range props(SCHEDULE_SECTION) {
+		validators = append(validators, &knf.Validator{
+			Property: SCHEDULE_SECTION + ":" + prop,
+			Func:     validateScheduleRule,
+		})
+	}
+
+	return validators
+}
+
+// validateScheduleRule is knf validator for maintenance window rule
+func validateScheduleRule(config *knf.Config, prop string, value interface{}) error {
+	_, err := parseScheduleRule(prop, config.GetS(prop))
+	return err
+}
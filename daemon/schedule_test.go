@@ -0,0 +1,230 @@
+package daemon
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+//                                                                                    //
+//                         Copyright (c) 2022 ESSENTIAL KAOS                          //
+//      Apache License, Version 2.0 <https://www.apache.org/licenses/LICENSE-2.0>     //
+//                                                                                    //
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+func TestParseScheduleRule(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		rule  *scheduleRule
+		isErr bool
+	}{
+		{
+			"weekly", "every fri 22:00 for 60h",
+			&scheduleRule{IsWeekly: true, Weekday: 5, Hour: 22, Duration: 60 * time.Hour}, false,
+		},
+		{
+			"daily", "every day 03:30 for 1h",
+			&scheduleRule{IsWeekly: true, Weekday: EVERY_DAY, Hour: 3, Minute: 30, Duration: time.Hour}, false,
+		},
+		{
+			"full weekday name and case", "  Every Sunday 00:00 for 2d ",
+			&scheduleRule{IsWeekly: true, Weekday: 0, Duration: 48 * time.Hour}, false,
+		},
+		{
+			"weeks", "every mon 10:00 for 1w",
+			&scheduleRule{IsWeekly: true, Weekday: 1, Hour: 10, Duration: 7 * 24 * time.Hour}, false,
+		},
+		{
+			"calendar with time", "2026-12-24 18:00 to 2026-12-27 09:00",
+			&scheduleRule{
+				Start: time.Date(2026, 12, 24, 18, 0, 0, 0, time.Local),
+				End:   time.Date(2026, 12, 27, 9, 0, 0, 0, time.Local),
+			}, false,
+		},
+		{
+			"calendar dates", "2026-12-24 to 2026-12-27",
+			&scheduleRule{
+				Start: time.Date(2026, 12, 24, 0, 0, 0, 0, time.Local),
+				End:   time.Date(2026, 12, 28, 0, 0, 0, 0, time.Local),
+			}, false,
+		},
+		{"unknown weekday", "every fry 22:00 for 1h", nil, true},
+		{"invalid time", "every fri 25:00 for 1h", nil, true},
+		{"missing for", "every fri 22:00 1h", nil, true},
+		{"invalid duration", "every fri 22:00 for 1y", nil, true},
+		{"zero duration", "every fri 22:00 for 0h", nil, true},
+		{"negative duration", "every fri 22:00 for -1h", nil, true},
+		{"zero days", "every fri 22:00 for 0d", nil, true},
+		{"longest weekly", "every fri 22:00 for 7d", &scheduleRule{IsWeekly: true, Weekday: 5, Hour: 22, Duration: 7 * 24 * time.Hour}, false},
+		{"too long weekly", "every fri 22:00 for 169h", nil, true},
+		{"too long calendar", "2026-12-01 to 2026-12-08", nil, true},
+		{"end before start", "2026-12-27 to 2026-12-24", nil, true},
+		{"same time", "2026-12-24 10:00 to 2026-12-24 10:00", nil, true},
+		{"invalid date", "2026-13-24 to 2026-12-27", nil, true},
+		{"single date", "2026-12-24", nil, true},
+		{"empty", "", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule, err := parseScheduleRule("test", tt.value)
+
+			if tt.isErr {
+				if err == nil {
+					t.Fatalf("Expected error, got rule %+v", rule)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			tt.rule.Name = "test"
+
+			if rule.Name != tt.rule.Name || rule.IsWeekly != tt.rule.IsWeekly ||
+				rule.Weekday != tt.rule.Weekday || rule.Hour != tt.rule.Hour ||
+				rule.Minute != tt.rule.Minute || rule.Duration != tt.rule.Duration ||
+				!rule.Start.Equal(tt.rule.Start) || !rule.End.Equal(tt.rule.End) {
+				t.Fatalf("Unexpected rule %+v, expected %+v", rule, tt.rule)
+			}
+		})
+	}
+}
+
+func TestScheduleRuleWindows(t *testing.T) {
+	// 2026-10-16 is Friday
+	from := time.Date(2026, 10, 16, 12, 0, 0, 0, time.Local)
+
+	tests := []struct {
+		name    string
+		value   string
+		from    time.Time
+		to      time.Time
+		windows [][2]time.Time
+	}{
+		{
+			"weekly upcoming", "every fri 22:00 for 60h", from, from.Add(24 * time.Hour),
+			[][2]time.Time{{
+				time.Date(2026, 10, 16, 22, 0, 0, 0, time.Local),
+				time.Date(2026, 10, 19, 10, 0, 0, 0, time.Local),
+			}},
+		},
+		{
+			"weekly started before period", "every fri 22:00 for 60h",
+			time.Date(2026, 10, 18, 12, 0, 0, 0, time.Local),
+			time.Date(2026, 10, 18, 12, 0, 1, 0, time.Local),
+			[][2]time.Time{{
+				time.Date(2026, 10, 16, 22, 0, 0, 0, time.Local),
+				time.Date(2026, 10, 19, 10, 0, 0, 0, time.Local),
+			}},
+		},
+		{
+			"weekly other day", "every mon 10:00 for 1h", from, from.Add(24 * time.Hour), nil,
+		},
+		{
+			"daily", "every day 03:00 for 1h", from, from.Add(48 * time.Hour),
+			[][2]time.Time{
+				{time.Date(2026, 10, 17, 3, 0, 0, 0, time.Local), time.Date(2026, 10, 17, 4, 0, 0, 0, time.Local)},
+				{time.Date(2026, 10, 18, 3, 0, 0, 0, time.Local), time.Date(2026, 10, 18, 4, 0, 0, 0, time.Local)},
+			},
+		},
+		{
+			"calendar inside", "2026-10-16 to 2026-10-17", from, from.Add(time.Hour),
+			[][2]time.Time{{
+				time.Date(2026, 10, 16, 0, 0, 0, 0, time.Local),
+				time.Date(2026, 10, 18, 0, 0, 0, 0, time.Local),
+			}},
+		},
+		{
+			"calendar ended", "2026-10-01 to 2026-10-02", from, from.Add(time.Hour), nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule, err := parseScheduleRule("test", tt.value)
+
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			windows := rule.Windows(tt.from, tt.to)
+
+			if len(windows) != len(tt.windows) {
+				t.Fatalf("Unexpected number of windows %d, expected %d", len(windows), len(tt.windows))
+			}
+
+			for i, w := range windows {
+				if w.Start != tt.windows[i][0].Unix() || w.End != tt.windows[i][1].Unix() {
+					t.Errorf(
+						"Unexpected window %s - %s, expected %s - %s",
+						time.Unix(w.Start, 0), time.Unix(w.End, 0), tt.windows[i][0], tt.windows[i][1],
+					)
+				}
+			}
+		})
+	}
+}
+
+func TestMergeWindows(t *testing.T) {
+	tests := []struct {
+		name    string
+		windows []*ScheduleWindow
+		result  []string
+	}{
+		{"empty", nil, nil},
+		{
+			"separate",
+			[]*ScheduleWindow{{300, 400, []string{"b"}}, {100, 200, []string{"a"}}},
+			[]string{"100-200 a", "300-400 b"},
+		},
+		{
+			"overlapping",
+			[]*ScheduleWindow{{100, 300, []string{"a"}}, {200, 400, []string{"b"}}},
+			[]string{"100-400 a+b"},
+		},
+		{
+			"adjacent",
+			[]*ScheduleWindow{{100, 200, []string{"a"}}, {200, 300, []string{"b"}}},
+			[]string{"100-300 a+b"},
+		},
+		{
+			"nested",
+			[]*ScheduleWindow{{100, 400, []string{"a"}}, {200, 300, []string{"b"}}},
+			[]string{"100-400 a+b"},
+		},
+		{
+			"same rule",
+			[]*ScheduleWindow{{100, 300, []string{"a"}}, {200, 400, []string{"a"}}},
+			[]string{"100-400 a"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var result []string
+
+			for _, w := range mergeWindows(tt.windows) {
+				result = append(result, formatTestWindow(w))
+			}
+
+			if strings.Join(result, ",") != strings.Join(tt.result, ",") {
+				t.Fatalf("Unexpected windows %v, expected %v", result, tt.result)
+			}
+		})
+	}
+}
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// formatTestWindow formats window for comparison
+func formatTestWindow(w *ScheduleWindow) string {
+	return fmt.Sprintf("%d-%d %s", w.Start, w.End, strings.Join(w.Names, "+"))
+}
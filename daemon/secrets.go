@@ -0,0 +1,193 @@
+package daemon
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+//                                                                                    //
+//                         Copyright (c) 2022 ESSENTIAL KAOS                          //
+//      Apache License, Version 2.0 <https://www.apache.org/licenses/LICENSE-2.0>     //
+//                                                                                    //
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/essentialkaos/ek/v12/fsutil"
+	"github.com/essentialkaos/ek/v12/jsonutil"
+	"github.com/essentialkaos/ek/v12/knf"
+	"github.com/essentialkaos/ek/v12/netutil"
+	"github.com/essentialkaos/ek/v12/passwd"
+)
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// Secrets contains hashed trigger key and path prefix
+type Secrets struct {
+	Prefix  string `json:"prefix"`
+	Salt    string `json:"salt"`
+	Hash    string `json:"hash"`
+	Created int64  `json:"created"`
+}
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// IsTriggerPath returns true if given request path is a path from bastion link
+func (s *Secrets) IsTriggerPath(path string) bool {
+	if s == nil || !strings.HasPrefix(path, s.Prefix+"/") {
+		return false
+	}
+
+	hash := hashKey(s.Salt, strings.TrimPrefix(path, s.Prefix+"/"))
+
+	return subtle.ConstantTimeCompare([]byte(hash), []byte(s.Hash)) == 1
+}
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// readSecrets read secrets from state file
+func readSecrets() (*Secrets, error) {
+	file := getStatePath(SECRETS_FILE)
+
+	if !fsutil.IsExist(file) {
+		return nil, nil
+	}
+
+	s := &Secrets{}
+	err := jsonutil.Read(file, s)
+
+	if err != nil {
+		return nil, fmt.Errorf("Can't read secrets file: %v", err)
+	}
+
+	if s.Hash == "" || s.Salt == "" {
+		return nil, fmt.Errorf("Secrets file %s is malformed", file)
+	}
+
+	return s, nil
+}
+
+// generateSecrets generate key and trigger path, save it to state file and
+// return bastion link
+func generateSecrets() (*Secrets, string, error) {
+	key := passwd.GenPassword(32, passwd.STRENGTH_MEDIUM)
+	salt, err := genSalt()
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	link := getBaseURL()
+	prefix := ""
+
+	if knf.GetS(MAIN_PATH) != "" {
+		prefix = "/" + strings.Trim(knf.GetS(MAIN_PATH), "/")
+	}
+
+	s := &Secrets{
+		Prefix:  prefix,
+		Salt:    salt,
+		Hash:    hashKey(salt, key),
+		Created: time.Now().Unix(),
+	}
+
+	err = writeJSONAtomic(getStatePath(SECRETS_FILE), s)
+
+	if err != nil {
+		return nil, "", fmt.Errorf("Can't save secrets: %v", err)
+	}
+
+	return s, link + prefix + "/" + key, nil
+}
+
+// createBootstrapToken generate one-time token for bastion link generation and
+// save it to root-owned file
+func createBootstrapToken() (string, error) {
+	token, err := genSalt()
+
+	if err != nil {
+		return "", err
+	}
+
+	err = writeFileAtomic(getStatePath(TOKEN_FILE), []byte(token+"\n"), 0600)
+
+	if err != nil {
+		return "", fmt.Errorf("Can't save bootstrap token: %v", err)
+	}
+
+	return token, nil
+}
+
+// isValidBootstrapToken return true if given token is equal to expected
+// one-time token
+func isValidBootstrapToken(expected, token string) bool {
+	if expected == "" || token == "" {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(token), []byte(expected)) == 1
+}
+
+// removeBootstrapToken remove one-time token
+func removeBootstrapToken() error {
+	file := getStatePath(TOKEN_FILE)
+
+	if !fsutil.IsExist(file) {
+		return nil
+	}
+
+	err := os.Remove(file)
+
+	if err != nil {
+		return fmt.Errorf("Can't remove bootstrap token: %v", err)
+	}
+
+	return nil
+}
+
+// getBaseURL return base part of bastion link
+func getBaseURL() string {
+	if knf.GetS(MAIN_URL) != "" {
+		return strings.TrimRight(knf.GetS(MAIN_URL), "/")
+	}
+
+	var link string
+
+	ip := knf.GetS(SERVER_IP)
+
+	if ip == "" {
+		link = "http://" + netutil.GetIP()
+	} else {
+		link = "http://" + ip
+	}
+
+	port := knf.GetS(SERVER_PORT)
+
+	if port != "" && port != "80" {
+		link += ":" + port
+	}
+
+	return link
+}
+
+// hashKey return salted hash of key
+func hashKey(salt, key string) string {
+	hash := sha256.Sum256([]byte(salt + key))
+	return hex.EncodeToString(hash[:])
+}
+
+// genSalt generate random salt
+func genSalt() (string, error) {
+	buf := make([]byte, 16)
+	_, err := rand.Read(buf)
+
+	if err != nil {
+		return "", fmt.Errorf("Can't generate salt: %v", err)
+	}
+
+	return hex.EncodeToString(buf), nil
+}
@@ -8,6 +8,12 @@ package daemon
 // ////////////////////////////////////////////////////////////////////////////////// //
 
 import (
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
 	"github.com/essentialkaos/ek/v12/knf"
 	"github.com/essentialkaos/ek/v12/log"
 
@@ -16,9 +22,41 @@ import (
 
 // ////////////////////////////////////////////////////////////////////////////////// //
 
+// PAGE_CONFIRM is markup of confirmation page
+const PAGE_CONFIRM = `<!DOCTYPE html>
+<html>
+<head><title>Bastion</title><meta name="robots" content="noindex, nofollow"></head>
+<body>
+<form method="POST">
+<p>Do you really want to enable bastion mode?</p>
+<p>%s<button type="submit">Enable</button></p>
+</form>
+</body>
+</html>
+`
+
+// PAGE_ENABLED is markup of page shown after enabling bastion mode
+const PAGE_ENABLED = `<!DOCTYPE html>
+<html>
+<head><title>Bastion</title><meta name="robots" content="noindex, nofollow"></head>
+<body><p>Bastion mode enabled.</p></body>
+</html>
+`
+
+// PAGE_DRY_RUN is markup of page shown if bastion mode wasn't enabled due to
+// dry-run mode
+const PAGE_DRY_RUN = `<!DOCTYPE html>
+<html>
+<head><title>Bastion</title><meta name="robots" content="noindex, nofollow"></head>
+<body><p>Dry-run mode is enabled, bastion mode wasn't enabled.</p></body>
+</html>
+`
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
 // startHTTPServer start HTTP server
 func startHTTPServer(ip, port string) error {
-	addr := ip + ":" + port
+	addr := net.JoinHostPort(ip, port)
 
 	log.Aux("%s %s HTTP server is started on %s", APP, VER, addr)
 
@@ -27,7 +65,17 @@ func startHTTPServer(ip, port string) error {
 		Name:    knf.GetS(SERVER_NAME, APP+"/"+VER),
 	}
 
-	return server.ListenAndServe(addr)
+	ln, err := net.Listen("tcp", addr)
+
+	if err != nil {
+		return err
+	}
+
+	if knf.GetB(SERVER_PROXY_PROTOCOL) {
+		ln = newProxyListener(ln)
+	}
+
+	return server.Serve(ln)
 }
 
 // fastHTTPHandler handler for fast http requests
@@ -35,21 +83,333 @@ func fastHTTPHandler(ctx *fasthttp.RequestCtx) {
 	defer requestRecover(ctx)
 
 	path := string(ctx.Path())
+	clientIP := getClientIP(ctx)
+	remoteIP := clientIP.String()
 
 	writeBasicInfo(ctx)
 
-	if key == "" && !bastionMode {
-		if path == "/go" {
-			ctx.WriteString(generateSecrets())
+	allowed, reason := requestGuard.checkClient(remoteIP)
+
+	if !allowed {
+		log.Debug("Request to \"%s\" from %s rejected: %s", path, remoteIP, reason)
+		ctx.SetStatusCode(429)
+		return
+	}
+
+	if path == "/go" {
+		processBootstrapRequest(ctx, clientIP)
+		return
+	}
+
+	if path == "/heartbeat" {
+		processHeartbeatRequest(ctx, clientIP)
+		return
+	}
+
+	if path == "/recover" {
+		processRecoveryRequest(ctx, clientIP)
+		return
+	}
+
+	if path == "/status" {
+		processStatusRequest(ctx, clientIP)
+		return
+	}
+
+	if ctrl.IsTriggerPath(path) {
+		processTriggerRequest(ctx, clientIP)
+		return
+	}
+
+	registerFailedRequest(remoteIP, fmt.Sprintf("Request to wrong path \"%s\"", path))
+}
+
+// registerFailedRequest registers failed request and enables bastion mode if
+// probing limit is reached
+func registerFailedRequest(remoteIP, reason string) {
+	if requestGuard.registerFail(remoteIP, reason) {
+		log.Warn("[SUSPICIOUS] Probing limit reached, enabling bastion mode...")
+		ctrl.Activate(&Trigger{Source: "probe", Actor: remoteIP, Reason: "Probing limit reached"})
+	}
+}
+
+// processTriggerRequest process request to bastion link
+func processTriggerRequest(ctx *fasthttp.RequestCtx, remoteIP net.IP) {
+	method := string(ctx.Method())
+
+	if !isAllowedClient(remoteIP) {
+		logEvent(
+			EVENT_LEVEL_WARN,
+			&Event{Event: EVENT_TRIGGER_REJECTED, Source: "http", Actor: remoteIP.String(), Error: "client is not in allowlist"},
+			"[SUSPICIOUS] Trigger request from %s rejected: client is not in allowlist",
+			remoteIP.String(),
+		)
+		ctx.SetStatusCode(403)
+		return
+	}
+
+	if !isTriggerMethod(method) {
+		if method == fasthttp.MethodGet {
+			log.Info("Confirmation page requested by %s", remoteIP.String())
+			ctx.WriteString(getConfirmationPage())
+		} else {
+			log.Info("Trigger request from %s ignored: method %s is not allowed", remoteIP.String(), method)
+			ctx.SetStatusCode(405)
+		}
+
+		return
+	}
+
+	if !isValidConfirmation(ctx) {
+		logEvent(
+			EVENT_LEVEL_WARN,
+			&Event{Event: EVENT_TRIGGER_REJECTED, Source: "http", Actor: remoteIP.String(), Error: "confirmation token is invalid"},
+			"[SUSPICIOUS] Trigger request from %s rejected: confirmation token is invalid",
+			remoteIP.String(),
+		)
+		ctx.SetStatusCode(403)
+		ctx.WriteString(getConfirmationPage())
+		return
+	}
+
+	profile := string(ctx.FormValue("profile"))
+
+	if profile != "" {
+		_, err := getProfile(profile)
+
+		if err != nil {
+			log.Info("Trigger request from %s rejected: %v", remoteIP.String(), err)
+			ctx.SetStatusCode(400)
+			return
 		}
+	}
+
+	// Request with profile to enabled bastion mode escalates it
+	if profile != "" && ctrl.State() == STATE_ACTIVE {
+		err := ctrl.Escalate(profile, remoteIP.String())
+
+		if err == ErrDryRun {
+			ctx.WriteString(PAGE_DRY_RUN)
+			return
+		}
+
+		if err != nil {
+			log.Info("Escalation request from %s ignored: %v", remoteIP.String(), err)
+		}
+
+		ctx.WriteString(PAGE_ENABLED)
+		return
+	}
+
+	err := ctrl.Activate(&Trigger{
+		Source:  "http",
+		Actor:   remoteIP.String(),
+		Reason:  "Request to bastion link",
+		Profile: profile,
+	})
 
+	if err == ErrDryRun {
+		ctx.WriteString(PAGE_DRY_RUN)
 		return
 	}
 
-	if path == bastionPath && !bastionMode {
-		bastionMode = true
-		go startBastionMode()
+	if err != nil {
+		log.Info("Trigger request from %s ignored: %v", remoteIP.String(), err)
+	}
+
+	ctx.WriteString(PAGE_ENABLED)
+}
+
+// processBootstrapRequest process request for bastion link generation
+func processBootstrapRequest(ctx *fasthttp.RequestCtx, remoteIP net.IP) {
+	if ctrl.IsLinkIssued() {
+		rejectBootstrapRequest(ctx, remoteIP, "link already issued")
+		return
 	}
+
+	isLocal := isLocalRequest(ctx, remoteIP)
+
+	if !isLocal && !isAllowedClient(remoteIP) {
+		rejectBootstrapRequest(ctx, remoteIP, "client is not in allowlist")
+		return
+	}
+
+	token := string(ctx.Request.Header.Peek("X-Bastion-Token"))
+	link, err := ctrl.IssueLink(token, isLocal)
+
+	switch err {
+	case nil:
+		// link issued
+	case ErrLinkIssued:
+		rejectBootstrapRequest(ctx, remoteIP, "link already issued")
+		return
+	case ErrInvalidToken:
+		rejectBootstrapRequest(ctx, remoteIP, "not direct loopback request and no valid token")
+		return
+	default:
+		log.Error(err.Error())
+		ctx.SetStatusCode(500)
+		return
+	}
+
+	logEvent(
+		EVENT_LEVEL_INFO,
+		&Event{Event: EVENT_BOOTSTRAP_ISSUED, Actor: remoteIP.String()},
+		"Bastion link issued to %s", remoteIP.String(),
+	)
+
+	ctx.WriteString(link)
+}
+
+// rejectBootstrapRequest rejects request for bastion link
+func rejectBootstrapRequest(ctx *fasthttp.RequestCtx, remoteIP net.IP, reason string) {
+	logEvent(
+		EVENT_LEVEL_WARN,
+		&Event{Event: EVENT_BOOTSTRAP_REJECTED, Actor: remoteIP.String(), Error: reason},
+		"[SUSPICIOUS] Request for bastion link from %s rejected: %s",
+		remoteIP.String(), reason,
+	)
+
+	ctx.SetStatusCode(403)
+}
+
+// processHeartbeatRequest process dead-man switch check-in
+func processHeartbeatRequest(ctx *fasthttp.RequestCtx, remoteIP net.IP) {
+	if !ctx.IsPost() {
+		ctx.SetStatusCode(405)
+		return
+	}
+
+	if !isAllowedClient(remoteIP) {
+		log.Warn(
+			"[SUSPICIOUS] Heartbeat from %s rejected: client is not in allowlist",
+			remoteIP.String(),
+		)
+		ctx.SetStatusCode(403)
+		return
+	}
+
+	err := deadman.CheckIn(
+		string(ctx.Request.Header.Peek("X-Bastion-Timestamp")),
+		string(ctx.Request.Header.Peek("X-Bastion-Signature")),
+		remoteIP.String(),
+	)
+
+	switch err {
+	case nil:
+		// heartbeat accepted
+	case ErrHeartbeatDisabled:
+		ctx.SetStatusCode(404)
+		return
+	default:
+		log.Warn("[SUSPICIOUS] Heartbeat from %s rejected: %v", remoteIP.String(), err)
+		ctx.SetStatusCode(403)
+		return
+	}
+
+	log.Debug("Heartbeat from %s accepted", remoteIP.String())
+
+	ctx.Response.Header.Set("Content-Type", "text/plain; charset=UTF-8")
+	ctx.WriteString(strconv.FormatInt(deadman.Deadline(), 10) + "\n")
+}
+
+// processRecoveryRequest process request for ending bastion mode with
+// recovery code
+func processRecoveryRequest(ctx *fasthttp.RequestCtx, remoteIP net.IP) {
+	if !ctx.IsPost() {
+		ctx.SetStatusCode(405)
+		return
+	}
+
+	if !remoteIP.IsLoopback() && !isAllowedClient(remoteIP) {
+		log.Warn(
+			"[SUSPICIOUS] Recovery request from %s rejected: client is not in allowlist",
+			remoteIP.String(),
+		)
+		ctx.SetStatusCode(403)
+		return
+	}
+
+	err := ctrl.Recover(string(ctx.PostArgs().Peek("code")), remoteIP.String())
+
+	ctx.Response.Header.Set("Content-Type", "text/plain; charset=UTF-8")
+
+	switch err {
+	case nil:
+		ctx.WriteString("Bastion mode disabled\n")
+	case ErrNotActive:
+		ctx.SetStatusCode(409)
+		ctx.WriteString(err.Error() + "\n")
+	case ErrRecoveryCodeInvalid, ErrRecoveryCodeSpent:
+		// Guessing of recovery codes is probing
+		registerFailedRequest(remoteIP.String(), "Invalid recovery code")
+		ctx.SetStatusCode(403)
+		ctx.WriteString(ErrRecoveryCodeInvalid.Error() + "\n")
+	default:
+		ctx.SetStatusCode(403)
+		ctx.WriteString(ErrRecoveryCodeInvalid.Error() + "\n")
+	}
+}
+
+// isLocalRequest returns true if request is sent directly from loopback
+// interface, such requests don't require bootstrap token
+func isLocalRequest(ctx *fasthttp.RequestCtx, clientIP net.IP) bool {
+	// With proxies every remote client can look like local one
+	if !knf.GetB(SERVER_TRUST_LOOPBACK, true) ||
+		knf.GetB(SERVER_PROXY_PROTOCOL) ||
+		len(getTrustedProxies()) != 0 {
+		return false
+	}
+
+	if !clientIP.IsLoopback() || !ctx.RemoteIP().IsLoopback() {
+		return false
+	}
+
+	// Local reverse proxy which isn't configured as trusted still adds
+	// forwarding headers to request
+	for _, header := range []string{"X-Forwarded-For", "X-Real-IP", "Forwarded"} {
+		if len(ctx.Request.Header.Peek(header)) != 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// isTriggerMethod returns true if given HTTP method can trigger bastion mode
+func isTriggerMethod(method string) bool {
+	for _, m := range strings.FieldsFunc(knf.GetS(TRIGGER_METHODS, "POST"), isListSeparator) {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isValidConfirmation returns true if request body contains valid confirmation
+// token or token is not required
+func isValidConfirmation(ctx *fasthttp.RequestCtx) bool {
+	confirm := knf.GetS(TRIGGER_CONFIRM)
+
+	if confirm == "" {
+		return true
+	}
+
+	token := ctx.PostArgs().Peek("confirm")
+
+	return subtle.ConstantTimeCompare(token, []byte(confirm)) == 1
+}
+
+// getConfirmationPage returns confirmation page markup
+func getConfirmationPage() string {
+	var field string
+
+	if knf.GetS(TRIGGER_CONFIRM) != "" {
+		field = `<input type="password" name="confirm" placeholder="Confirmation token" required> `
+	}
+
+	return fmt.Sprintf(PAGE_CONFIRM, field)
 }
 
 // requestRecover recover panic in request
@@ -0,0 +1,354 @@
+package daemon
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+//                                                                                    //
+//                         Copyright (c) 2022 ESSENTIAL KAOS                          //
+//      Apache License, Version 2.0 <https://www.apache.org/licenses/LICENSE-2.0>     //
+//                                                                                    //
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/essentialkaos/ek/v12/fsutil"
+	"github.com/essentialkaos/ek/v12/knf"
+	"github.com/essentialkaos/ek/v12/log"
+)
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// SSHD_DROPIN_NAME is name of sshd configuration snippet, it must be first
+// in lexical order because sshd uses first obtained value of each option
+const SSHD_DROPIN_NAME = "00-bastion.conf"
+
+// DEFAULT_SSHD_CONFIG_DIR is default path to sshd drop-in configuration directory
+const DEFAULT_SSHD_CONFIG_DIR = "/etc/ssh/sshd_config.d"
+
+// EVENT_SSHD_INVALID is name of event sent if sshd configuration is invalid
+// after removing configuration snippet
+const EVENT_SSHD_INVALID = "sshd-invalid"
+
+// SSHD_CHECK_ADDR is address from documentation range used for checking
+// Match blocks for clients from unknown networks
+const SSHD_CHECK_ADDR = "192.0.2.1"
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// sshdDirectiveAliases contains names used in sshd -T output for deprecated
+// directives
+var sshdDirectiveAliases = map[string]string{
+	"challengeresponseauthentication": "kbdinteractiveauthentication",
+}
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// newRestrictSSHDAction creates action which restricts sshd configuration
+func newRestrictSSHDAction() *Action {
+	return &Action{
+		Name:   ACTION_RESTRICT_SSHD,
+		Apply:  applySSHDRestrictions,
+		Revert: revertSSHDRestrictions,
+		Check:  isSSHDRestricted,
+	}
+}
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// applySSHDRestrictions writes sshd configuration snippet and reloads sshd
+func applySSHDRestrictions() error {
+	log.Info("Restricting sshd configuration...")
+
+	if knf.GetS(RESTRICTED_USERS) == "" && knf.GetS(RESTRICTED_NETS) == "" {
+		return fmt.Errorf("Can't restrict sshd: allowed users and networks are not set")
+	}
+
+	err := checkSSHDConfig()
+
+	if err != nil {
+		return fmt.Errorf("Current sshd configuration is invalid: %v", err)
+	}
+
+	file := getSSHDDropInPath()
+	err = writeFileAtomic(file, []byte(genSSHDDropIn()), 0600)
+
+	if err != nil {
+		return fmt.Errorf("Can't write sshd configuration snippet: %v", err)
+	}
+
+	err = checkSSHDConfig()
+
+	if err == nil {
+		err = checkSSHDEffectiveConfig()
+	}
+
+	if err != nil {
+		os.Remove(file)
+		return fmt.Errorf("sshd configuration with restrictions is invalid: %v", err)
+	}
+
+	err = reloadService("sshd")
+
+	if err != nil {
+		return err
+	}
+
+	log.Info("sshd configuration restricted")
+
+	return nil
+}
+
+// revertSSHDRestrictions removes sshd configuration snippet and reloads sshd
+func revertSSHDRestrictions() error {
+	log.Info("Restoring sshd configuration...")
+
+	file := getSSHDDropInPath()
+
+	if fsutil.IsExist(file) {
+		err := os.Remove(file)
+
+		if err != nil {
+			return fmt.Errorf("Can't remove sshd configuration snippet: %v", err)
+		}
+	}
+
+	err := checkSSHDConfig()
+
+	// sshd keeps working with restricted configuration, so it must be fixed
+	// manually before reverting can be retried
+	if err != nil {
+		message := fmt.Sprintf("sshd configuration without %s is invalid: %v", file, err)
+		log.Crit("[IMPORTANT] %s", message)
+		sendNotification(EVENT_SSHD_INVALID, message, map[string]string{"action": ACTION_RESTRICT_SSHD})
+		return fmt.Errorf("Restored sshd configuration is invalid: %v", err)
+	}
+
+	err = reloadService("sshd")
+
+	if err != nil {
+		return err
+	}
+
+	log.Info("sshd configuration restored")
+
+	return nil
+}
+
+// isSSHDRestricted returns true if sshd configuration snippet is in place
+func isSSHDRestricted() (bool, error) {
+	data, err := os.ReadFile(getSSHDDropInPath())
+
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	return string(data) == genSSHDDropIn(), nil
+}
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// genSSHDDropIn generates sshd configuration snippet
+func genSSHDDropIn() string {
+	var allowed []string
+
+	users := strings.FieldsFunc(knf.GetS(RESTRICTED_USERS), isListSeparator)
+	nets := strings.FieldsFunc(knf.GetS(RESTRICTED_NETS), isListSeparator)
+
+	switch {
+	case len(nets) == 0:
+		allowed = users
+	case len(users) == 0:
+		for _, n := range nets {
+			allowed = append(allowed, "*@"+n)
+		}
+	default:
+		for _, u := range users {
+			for _, n := range nets {
+				allowed = append(allowed, u+"@"+n)
+			}
+		}
+	}
+
+	result := "# Generated by " + APP + ", will be removed at the end of bastion mode\n"
+	result += "PasswordAuthentication no\n"
+	result += "ChallengeResponseAuthentication no\n"
+	result += "AllowUsers " + strings.Join(allowed, " ") + "\n"
+
+	if knf.GetS(RESTRICTED_KEYS) != "" {
+		result += "AuthorizedKeysFile " + knf.GetS(RESTRICTED_KEYS) + "\n"
+	}
+
+	return result
+}
+
+// getSSHDDropInPath returns path to sshd configuration snippet
+func getSSHDDropInPath() string {
+	return filepath.Join(
+		knf.GetS(RESTRICTED_CONFIG_DIR, DEFAULT_SSHD_CONFIG_DIR),
+		SSHD_DROPIN_NAME,
+	)
+}
+
+// checkSSHDConfig checks sshd configuration using sshd -t
+func checkSSHDConfig() error {
+	output, err := exec.Command("sshd", "-t").CombinedOutput()
+
+	if err != nil {
+		return fmt.Errorf("sshd -t failed: %s", strings.TrimSpace(string(output)))
+	}
+
+	return nil
+}
+
+// checkSSHDEffectiveConfig checks that all directives from configuration
+// snippet are in effective sshd configuration, including configuration for
+// allowed and unknown clients, so overrides from Match blocks are detected
+func checkSSHDEffectiveConfig() error {
+	expected := parseSSHDConfig(genSSHDDropIn())
+
+	for _, spec := range getSSHDConnectionSpecs() {
+		args := []string{"-T"}
+
+		if spec != "" {
+			args = append(args, "-C", spec)
+		}
+
+		output, err := exec.Command("sshd", args...).Output()
+
+		if err != nil {
+			return fmt.Errorf("sshd %s failed: %v", strings.Join(args, " "), err)
+		}
+
+		effective := parseSSHDConfig(string(output))
+
+		for name, values := range expected {
+			actual, ok := effective[name]
+
+			if !ok && sshdDirectiveAliases[name] != "" {
+				actual = effective[sshdDirectiveAliases[name]]
+			}
+
+			if !isSameFields(values, actual) {
+				return fmt.Errorf(
+					"Directive %s is overridden (%s), check that %s is included to sshd_config before other files and Match blocks",
+					name, formatConnectionSpec(spec), getSSHDDropInPath(),
+				)
+			}
+		}
+	}
+
+	return nil
+}
+
+// getSSHDConnectionSpecs returns sshd -C connection specifications for
+// checking effective configuration
+func getSSHDConnectionSpecs() []string {
+	specs := []string{"", "user=root,host=" + SSHD_CHECK_ADDR + ",addr=" + SSHD_CHECK_ADDR}
+
+	users := strings.FieldsFunc(knf.GetS(RESTRICTED_USERS), isListSeparator)
+	nets, _ := parseNetList(knf.GetS(RESTRICTED_NETS))
+
+	if len(users) == 0 {
+		users = []string{"root"}
+	}
+
+	addrs := []string{SSHD_CHECK_ADDR}
+
+	if len(nets) != 0 {
+		addrs = nil
+
+		for _, n := range nets {
+			addrs = append(addrs, n.IP.String())
+		}
+	}
+
+	for _, user := range users {
+		for _, addr := range addrs {
+			specs = append(specs, "user="+user+",host="+addr+",addr="+addr)
+		}
+	}
+
+	return specs
+}
+
+// parseSSHDConfig parses sshd configuration or sshd -T output to map with
+// lowercased directives names and values, values of repeated directives
+// are joined
+func parseSSHDConfig(data string) map[string][]string {
+	result := make(map[string][]string)
+
+	for _, line := range strings.Split(data, "\n") {
+		fields := strings.Fields(line)
+
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		name := strings.ToLower(fields[0])
+		result[name] = append(result[name], fields[1:]...)
+	}
+
+	return result
+}
+
+// isSameFields returns true if both slices contain the same values
+// ignoring order and case
+func isSameFields(expected, actual []string) bool {
+	if len(expected) != len(actual) {
+		return false
+	}
+
+	counts := make(map[string]int)
+
+	for _, v := range expected {
+		counts[strings.ToLower(v)]++
+	}
+
+	for _, v := range actual {
+		counts[strings.ToLower(v)]--
+	}
+
+	for _, c := range counts {
+		if c != 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// formatConnectionSpec returns description of connection specification
+func formatConnectionSpec(spec string) string {
+	if spec == "" {
+		return "global configuration"
+	}
+
+	return "connection " + spec
+}
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// validateRestrictedUsers is knf validator for restricted sshd settings
+func validateRestrictedUsers(config *knf.Config, prop string, value interface{}) error {
+	profile := findConfigProfile(config, "")
+
+	if profile == nil || !profile.HasAction(ACTION_RESTRICT_SSHD) {
+		return nil
+	}
+
+	if config.GetS(RESTRICTED_USERS) == "" && config.GetS(RESTRICTED_NETS) == "" {
+		return fmt.Errorf(
+			"Property %s or %s must be set for %s profile",
+			RESTRICTED_USERS, RESTRICTED_NETS, profile.Name,
+		)
+	}
+
+	return nil
+}
@@ -0,0 +1,281 @@
+package daemon
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+//                                                                                    //
+//                         Copyright (c) 2022 ESSENTIAL KAOS                          //
+//      Apache License, Version 2.0 <https://www.apache.org/licenses/LICENSE-2.0>     //
+//                                                                                    //
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/essentialkaos/ek/v12/fsutil"
+	"github.com/essentialkaos/ek/v12/jsonutil"
+	"github.com/essentialkaos/ek/v12/knf"
+	"github.com/essentialkaos/ek/v12/log"
+)
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// DEFAULT_STATE_DIR is default path to directory with state files
+const DEFAULT_STATE_DIR = "/var/lib/bastion"
+
+// State files names
+const (
+	MARKER_FILE    = "marker.json"
+	KEY_FILE       = "marker.key"
+	JOURNAL_FILE   = "journal.json"
+	SECRETS_FILE   = "secrets.json"
+	TOKEN_FILE     = "token"
+	ATTEMPTS_FILE  = "attempts.log"
+	SCHEDULE_FILE  = "schedule.json"
+	HEARTBEAT_FILE = "heartbeat.json"
+	RECOVERY_FILE  = "recovery.json"
+)
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// legacyStateFile contains path to state file used by previous versions and
+// name of file in state directory
+type legacyStateFile struct {
+	Path string
+	Name string
+}
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// legacyStateFiles is ordered list of state files used by previous versions,
+// key must be moved before marker
+var legacyStateFiles = []legacyStateFile{
+	{"/root/.bastion.key", KEY_FILE},
+	{"/root/.bastion.secrets", SECRETS_FILE},
+	{"/root/.bastion.token", TOKEN_FILE},
+	{"/root/.bastion.journal", JOURNAL_FILE},
+	{"/root/.bastion", MARKER_FILE},
+}
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// stateDir is path to directory with state files
+var stateDir = DEFAULT_STATE_DIR
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// getStatePath returns path to state file with given name
+func getStatePath(name string) string {
+	return filepath.Join(stateDir, name)
+}
+
+// createStateDir creates state directory if it doesn't exist
+func createStateDir() error {
+	if fsutil.IsExist(stateDir) {
+		return nil
+	}
+
+	err := os.MkdirAll(stateDir, 0700)
+
+	if err != nil {
+		return fmt.Errorf("Can't create state directory: %v", err)
+	}
+
+	return nil
+}
+
+// migrateLegacyState moves state files used by previous versions to state
+// directory, so enabled bastion mode isn't lost after upgrade
+func migrateLegacyState() error {
+	var isMarkerMoved bool
+
+	for _, file := range legacyStateFiles {
+		if !fsutil.IsExist(file.Path) {
+			continue
+		}
+
+		target := getStatePath(file.Name)
+
+		if fsutil.IsExist(target) {
+			log.Warn("Legacy state file %s ignored: %s already exists", file.Path, target)
+			continue
+		}
+
+		err := moveStateFile(file.Path, target)
+
+		if err != nil {
+			return fmt.Errorf("Can't move legacy state file %s to %s: %v", file.Path, target, err)
+		}
+
+		log.Info("[IMPORTANT] Legacy state file %s moved to %s", file.Path, target)
+
+		isMarkerMoved = isMarkerMoved || file.Name == MARKER_FILE
+	}
+
+	// Only marker moved from legacy path is converted, unsigned marker found
+	// in state directory is processed by marker policy
+	if !isMarkerMoved {
+		return nil
+	}
+
+	return migrateLegacyMarker()
+}
+
+// migrateLegacyMarker converts unsigned marker created by previous versions
+// to current format
+func migrateLegacyMarker() error {
+	marker := &BastionMarker{}
+	err := jsonutil.Read(getStatePath(MARKER_FILE), marker)
+
+	// Malformed marker is processed by marker policy
+	if err != nil || marker.Version != 0 || marker.Until <= marker.Started {
+		return nil
+	}
+
+	// Legacy marker is unsigned, so key for it is created
+	if !fsutil.IsExist(getStatePath(KEY_FILE)) {
+		_, err = createMarkerKey()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	marker.Version = MARKER_VERSION
+	marker.Duration = marker.Until - marker.Started
+	marker.Elapsed = time.Now().Unix() - marker.Started
+
+	if marker.Elapsed > marker.Duration {
+		marker.Elapsed = marker.Duration
+	}
+
+	marker.BootID, marker.Uptime = getBootID(), getUptime()
+	marker.Source, marker.Actor = "legacy", APP
+	marker.Reason = "Marker created by previous version"
+	marker.Profile = PROFILE_STANDARD
+
+	// Previous versions always applied actions of standard profile
+	for _, action := range getActions(PROFILE_STANDARD) {
+		marker.Actions = append(marker.Actions, &MarkerAction{action.Name, false})
+	}
+
+	err = saveBastionMarker(marker)
+
+	if err != nil {
+		return fmt.Errorf("Can't convert legacy bastion marker: %v", err)
+	}
+
+	log.Info("[IMPORTANT] Legacy bastion marker converted to version %d", MARKER_VERSION)
+
+	return nil
+}
+
+// moveStateFile moves file to state directory, file is copied because
+// state directory can be on another file system
+func moveStateFile(from, to string) error {
+	data, err := os.ReadFile(from)
+
+	if err != nil {
+		return err
+	}
+
+	err = writeFileAtomic(to, data, 0600)
+
+	if err != nil {
+		return err
+	}
+
+	return os.Remove(from)
+}
+
+// writeJSONAtomic encodes data to JSON and atomically writes it to file
+func writeJSONAtomic(file string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(file, append(data, '\n'), 0600)
+}
+
+// writeFileAtomic atomically writes data to file using temporary file
+func writeFileAtomic(file string, data []byte, perms os.FileMode) error {
+	dir := filepath.Dir(file)
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(file)+".*")
+
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(tmp.Name())
+
+	err = tmp.Chmod(perms)
+
+	if err == nil {
+		_, err = tmp.Write(data)
+	}
+
+	if err == nil {
+		err = tmp.Sync()
+	}
+
+	closeErr := tmp.Close()
+
+	if err != nil {
+		return err
+	}
+
+	if closeErr != nil {
+		return closeErr
+	}
+
+	err = os.Rename(tmp.Name(), file)
+
+	if err != nil {
+		return err
+	}
+
+	return syncDir(dir)
+}
+
+// syncDir flushes directory metadata to disk
+func syncDir(dir string) error {
+	fd, err := os.Open(dir)
+
+	if err != nil {
+		return err
+	}
+
+	defer fd.Close()
+
+	return fd.Sync()
+}
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// validateStateDir is knf validator for state directory
+func validateStateDir(config *knf.Config, prop string, value interface{}) error {
+	dir := config.GetS(prop, DEFAULT_STATE_DIR)
+
+	if !fsutil.IsExist(dir) {
+		if !fsutil.IsWritable(filepath.Dir(dir)) {
+			return fmt.Errorf("Can't create state directory %s: parent directory is not writable", dir)
+		}
+
+		return nil
+	}
+
+	switch {
+	case !fsutil.IsDir(dir):
+		return fmt.Errorf("State directory %s is not a directory", dir)
+	case !fsutil.IsWritable(dir):
+		return fmt.Errorf("State directory %s is not writable", dir)
+	case fsutil.GetMode(dir)&0022 != 0:
+		return fmt.Errorf("State directory %s is writable by group or others", dir)
+	}
+
+	return nil
+}
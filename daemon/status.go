@@ -0,0 +1,147 @@
+package daemon
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+//                                                                                    //
+//                         Copyright (c) 2022 ESSENTIAL KAOS                          //
+//      Apache License, Version 2.0 <https://www.apache.org/licenses/LICENSE-2.0>     //
+//                                                                                    //
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+import (
+	"encoding/json"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/essentialkaos/ek/v12/fsutil"
+	"github.com/essentialkaos/ek/v12/log"
+	"github.com/essentialkaos/ek/v12/timeutil"
+
+	"github.com/valyala/fasthttp"
+)
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// Status contains info about current bastion state
+type Status struct {
+	State     string            `json:"state"`
+	Started   int64             `json:"started,omitempty"`
+	Until     int64             `json:"until,omitempty"`
+	Remaining int64             `json:"remaining,omitempty"`
+	Source    string            `json:"source,omitempty"`
+	Actor     string            `json:"actor,omitempty"`
+	Reason    string            `json:"reason,omitempty"`
+	Profile   string            `json:"profile,omitempty"`
+	Attempts  *AttemptsSummary  `json:"attempts"`
+	Schedule  []*ScheduleWindow `json:"schedule,omitempty"`
+	Deadline  int64             `json:"deadman_deadline,omitempty"`
+}
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// getStatus collects info about current bastion state
+func getStatus() *Status {
+	status := &Status{
+		State:    ctrl.State().String(),
+		Attempts: sshDecoy.Summary(),
+		Schedule: getUpcomingWindows(),
+		Deadline: deadman.Deadline(),
+	}
+
+	marker := ctrl.Marker()
+
+	if marker != nil {
+		status.Started = marker.Started
+		status.Until = marker.Until
+		status.Remaining = ctrl.Remaining()
+		status.Source = marker.Source
+		status.Actor = marker.Actor
+		status.Reason = marker.Reason
+		status.Profile = marker.Profile
+	}
+
+	return status
+}
+
+// processStatusRequest process request for bastion status
+func processStatusRequest(ctx *fasthttp.RequestCtx, remoteIP net.IP) {
+	if !remoteIP.IsLoopback() && (len(getAllowedNets()) == 0 || !isAllowedClient(remoteIP)) {
+		log.Warn(
+			"[SUSPICIOUS] Status request from %s rejected: client is not in allowlist",
+			remoteIP.String(),
+		)
+		ctx.SetStatusCode(403)
+		return
+	}
+
+	data, err := json.MarshalIndent(getStatus(), "", "  ")
+
+	if err != nil {
+		log.Error("Can't encode status: %v", err)
+		ctx.SetStatusCode(500)
+		return
+	}
+
+	ctx.Response.Header.Set("Content-Type", "application/json")
+	ctx.Write(append(data, '\n'))
+}
+
+// dumpStatus writes full info about current bastion state to log
+func dumpStatus() {
+	status := getStatus()
+
+	log.Info("State dump: state is %s", status.State)
+
+	marker := ctrl.Marker()
+
+	if marker != nil {
+		log.Info(
+			"State dump: bastion mode started %s, will end %s (%s remaining)",
+			formatTimestamp(marker.Started), formatTimestamp(marker.Until),
+			timeutil.PrettyDuration(status.Remaining),
+		)
+		log.Info(
+			"State dump: source: %s, actor: %s, reason: %s, profile: %s",
+			marker.Source, marker.Actor, marker.Reason, marker.Profile,
+		)
+	}
+
+	for _, action := range getMarkerActions(marker) {
+		applied, err := action.Check()
+
+		switch {
+		case err != nil:
+			log.Info("State dump: action %s check failed: %v", action.Name, err)
+		case marker != nil && marker.GetAction(action.Name) != nil:
+			log.Info("State dump: action %s is recorded in marker (applied: %t)", action.Name, applied)
+		default:
+			log.Info("State dump: action %s is not recorded in marker (applied: %t)", action.Name, applied)
+		}
+	}
+
+	log.Info(
+		"State dump: link issued: %t, unfinished transaction: %t",
+		ctrl.IsLinkIssued(), fsutil.IsExist(getStatePath(JOURNAL_FILE)),
+	)
+
+	for _, window := range status.Schedule {
+		log.Info(
+			"State dump: maintenance window %s from %s to %s",
+			strings.Join(window.Names, "+"), formatTimestamp(window.Start), formatTimestamp(window.End),
+		)
+	}
+
+	if status.Deadline != 0 {
+		log.Info("State dump: dead-man switch deadline is %s", formatTimestamp(status.Deadline))
+	}
+
+	log.Info(
+		"State dump: decoy attempts: %d from %d unique IPs",
+		status.Attempts.Total, status.Attempts.UniqueIPs,
+	)
+}
+
+// formatTimestamp formats unix timestamp as date
+func formatTimestamp(ts int64) string {
+	return timeutil.Format(time.Unix(ts, 0), "%Y/%m/%d %H:%M:%S")
+}
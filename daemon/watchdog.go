@@ -0,0 +1,66 @@
+package daemon
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+//                                                                                    //
+//                         Copyright (c) 2022 ESSENTIAL KAOS                          //
+//      Apache License, Version 2.0 <https://www.apache.org/licenses/LICENSE-2.0>     //
+//                                                                                    //
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+import (
+	"fmt"
+
+	"github.com/essentialkaos/ek/v12/knf"
+	"github.com/essentialkaos/ek/v12/log"
+)
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// EVENT_DRIFT is name of event sent when drift of applied action is detected
+const EVENT_DRIFT = "drift"
+
+// ////////////////////////////////////////////////////////////////////////////////// //
+
+// enforceActions checks all applied actions and re-applies drifted ones
+func enforceActions(marker *BastionMarker) {
+	if marker == nil {
+		return
+	}
+
+	for _, action := range getMarkerActions(marker) {
+		if action.OneShot || marker.GetAction(action.Name) == nil {
+			continue
+		}
+
+		applied, err := action.Check()
+
+		if err != nil {
+			log.Error("Can't check state of action %s: %v", action.Name, err)
+			continue
+		}
+
+		if applied {
+			continue
+		}
+
+		message := fmt.Sprintf("Action %s is not applied anymore", action.Name)
+
+		logEvent(
+			EVENT_LEVEL_CRIT,
+			&Event{Event: EVENT_ACTION_DRIFT, Action: action.Name},
+			"[IMPORTANT] Drift detected: %s, re-applying...", message,
+		)
+
+		sendNotification(EVENT_DRIFT, message, map[string]string{"action": action.Name})
+
+		if knf.HasProp(SCRIPT_DRIFT) {
+			runScript(
+				knf.GetS(SCRIPT_DRIFT),
+				"BASTION_EVENT="+EVENT_DRIFT,
+				"BASTION_ACTION="+action.Name,
+			)
+		}
+
+		reapplyAction(action)
+	}
+}